@@ -0,0 +1,281 @@
+package qcd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+)
+
+// DiffChange classifies a record in a diff.
+type DiffChange int
+
+const (
+	// Matched records are in the same position in both sources.
+	Matched DiffChange = iota
+	// Added records are only in the right (new) source.
+	Added
+	// Removed records are only in the left (base) source.
+	Removed
+	// Moved records are in both sources but out of order.
+	Moved
+)
+
+var diffChangeNames = [...]string{"matched", "added", "removed", "moved"}
+
+func (c DiffChange) String() string {
+	if int(c) < len(diffChangeNames) {
+		return diffChangeNames[c]
+	}
+	return fmt.Sprintf("DiffChange(%d)", int(c))
+}
+
+// prefix is the single character used for each change in text diffs.
+func (c DiffChange) prefix() string {
+	switch c {
+	case Added:
+		return "+"
+	case Removed:
+		return "-"
+	case Moved:
+		return "*"
+	}
+	return " "
+}
+
+// DiffEvent describes a single record reported by a diff.
+type DiffEvent struct {
+	Change DiffChange
+	Record string
+
+	// LeftLine and RightLine are the 1-based record numbers in each
+	// source, or 0 if unknown or not present in that source.
+	LeftLine  int
+	RightLine int
+}
+
+// DiffSummary counts the records reported by a diff.
+type DiffSummary struct {
+	// Identical records are in the same position in both sources.
+	Identical int `json:"identical"`
+	// Moved records are in both sources but out of order.
+	Moved int `json:"moved"`
+	// Added records are only in the right (new) source.
+	Added int `json:"added"`
+	// Removed records are only in the left (base) source.
+	Removed int `json:"removed"`
+	// DuplicatesChanged is the number of distinct records that are in
+	// both sources, but a different number of times.
+	DuplicatesChanged int `json:"duplicates_changed"`
+}
+
+func (d *DiffSummary) add(c DiffChange) {
+	switch c {
+	case Matched:
+		d.Identical++
+	case Added:
+		d.Added++
+	case Removed:
+		d.Removed++
+	case Moved:
+		d.Moved++
+	}
+}
+
+// Same returns true if both sources contain the same records,
+// regardless of their order.
+func (d DiffSummary) Same() bool {
+	return d.Added == 0 && d.Removed == 0
+}
+
+// Reordered returns true if both sources contain the same records,
+// but in a different order.
+func (d DiffSummary) Reordered() bool {
+	return d.Same() && d.Moved > 0
+}
+
+func (d DiffSummary) String() string {
+	return fmt.Sprintf("%d identical, %d moved, %d added, %d removed, %d duplicates changed",
+		d.Identical, d.Moved, d.Added, d.Removed, d.DuplicatesChanged)
+}
+
+// DiffSink receives the records compared by a diff, in output order.
+type DiffSink interface {
+	// Event is called for every record reported by the diff.
+	Event(e DiffEvent) error
+
+	// Close is called once the diff is complete.
+	Close() error
+}
+
+/////////
+
+type discardDiffSink struct{}
+
+// DiscardDiffSink is a DiffSink that ignores all records, for when
+// only the DiffSummary is needed.
+var DiscardDiffSink DiffSink = discardDiffSink{}
+
+func (discardDiffSink) Event(DiffEvent) error { return nil }
+func (discardDiffSink) Close() error          { return nil }
+
+/////////
+
+type textDiffSink struct {
+	w io.Writer
+}
+
+// NewTextDiffSink returns a DiffSink that writes records prefixed with
+// " " (matched), "+" (added), "-" (removed) or "*" (moved), in the
+// style of a unified diff.
+func NewTextDiffSink(w io.Writer) DiffSink {
+	return &textDiffSink{w: w}
+}
+
+func (t *textDiffSink) Event(e DiffEvent) error {
+	_, err := fmt.Fprintln(t.w, e.Change.prefix()+e.Record)
+	return err
+}
+
+func (t *textDiffSink) Close() error {
+	return nil
+}
+
+/////////
+
+type jsonLinesDiffSink struct {
+	enc *json.Encoder
+}
+
+type jsonDiffEvent struct {
+	Change    string `json:"change"`
+	Record    string `json:"record"`
+	LeftLine  int    `json:"left_line,omitempty"`
+	RightLine int    `json:"right_line,omitempty"`
+}
+
+// NewJSONLinesDiffSink returns a DiffSink that writes one JSON object
+// per record, with "change", "record", "left_line" and "right_line" keys.
+func NewJSONLinesDiffSink(w io.Writer) DiffSink {
+	return &jsonLinesDiffSink{enc: json.NewEncoder(w)}
+}
+
+func (j *jsonLinesDiffSink) Event(e DiffEvent) error {
+	return j.enc.Encode(jsonDiffEvent{
+		Change:    e.Change.String(),
+		Record:    e.Record,
+		LeftLine:  e.LeftLine,
+		RightLine: e.RightLine,
+	})
+}
+
+func (j *jsonLinesDiffSink) Close() error {
+	return nil
+}
+
+/////////
+
+type csvDiffSink struct {
+	cw     *csv.Writer
+	header bool
+}
+
+// NewCSVDiffSink returns a DiffSink that writes a CSV file with the
+// columns change, left_line, right_line and record.
+func NewCSVDiffSink(w io.Writer) DiffSink {
+	return &csvDiffSink{cw: csv.NewWriter(w)}
+}
+
+func lineString(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+func (c *csvDiffSink) Event(e DiffEvent) error {
+	if !c.header {
+		c.header = true
+		c.cw.Write([]string{"change", "left_line", "right_line", "record"})
+	}
+	return c.cw.Write([]string{e.Change.String(),
+		lineString(e.LeftLine), lineString(e.RightLine), e.Record})
+}
+
+func (c *csvDiffSink) Close() error {
+	if !c.header {
+		c.header = true
+		c.cw.Write([]string{"change", "left_line", "right_line", "record"})
+	}
+	c.cw.Flush()
+	return c.cw.Error()
+}
+
+/////////
+
+type htmlDiffSink struct {
+	w      io.Writer
+	title  string
+	counts [len(diffChangeNames)]int
+	header bool
+}
+
+// NewHTMLDiffSink returns a DiffSink that writes a standalone HTML report
+// with a color-coded table of records and a count of each change type.
+func NewHTMLDiffSink(w io.Writer, title string) DiffSink {
+	return &htmlDiffSink{w: w, title: title}
+}
+
+const htmlDiffHeader = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>%s</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; font-family: monospace; }
+td { padding: 0 0.5em; white-space: pre; }
+td.n { color: #888; text-align: right; }
+tr.added { background: #e6ffec; }
+tr.removed { background: #ffebe9; }
+tr.moved { background: #fff8c5; }
+</style></head><body>
+<h1>%s</h1>
+<table>
+<tr><th>left</th><th>right</th><th></th><th>record</th></tr>
+`
+
+func (h *htmlDiffSink) writeHeader() error {
+	h.header = true
+	t := html.EscapeString(h.title)
+	_, err := fmt.Fprintf(h.w, htmlDiffHeader, t, t)
+	return err
+}
+
+func (h *htmlDiffSink) Event(e DiffEvent) error {
+	if !h.header {
+		if err := h.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if int(e.Change) < len(h.counts) {
+		h.counts[e.Change]++
+	}
+	_, err := fmt.Fprintf(h.w, "<tr class=\"%s\"><td class=\"n\">%s</td><td class=\"n\">%s</td><td>%s</td><td>%s</td></tr>\n",
+		e.Change, lineString(e.LeftLine), lineString(e.RightLine),
+		html.EscapeString(e.Change.prefix()), html.EscapeString(e.Record))
+	return err
+}
+
+func (h *htmlDiffSink) Close() error {
+	if !h.header {
+		if err := h.writeHeader(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(h.w, "</table>\n<ul>")
+	for c, n := range h.counts {
+		fmt.Fprintf(h.w, "<li>%d %s</li>\n", n, diffChangeNames[c])
+	}
+	_, err := fmt.Fprintln(h.w, "</ul>\n</body></html>")
+	return err
+}
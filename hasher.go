@@ -0,0 +1,170 @@
+package qcd
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sort"
+
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/blake3"
+)
+
+// Hasher computes the 32-byte digest of individual records. All
+// implementations produce sha256.Size digests so that the quicksum
+// filters and the content hash combiner work unchanged.
+type Hasher interface {
+	// Name is the algorithm identifier stored in the verification data.
+	Name() string
+
+	// Cryptographic reports whether the algorithm is collision resistant,
+	// and thus suitable for keyed hashing.
+	Cryptographic() bool
+
+	// New returns a streaming hash.Hash producing a 32-byte digest.
+	New() hash.Hash
+
+	// Sum256 returns the digest of a complete record.
+	Sum256(record []byte) [sha256.Size]byte
+}
+
+// DefaultHasher is the record hash algorithm used when none is specified,
+// and the algorithm assumed for verification data which does not name one.
+const DefaultHasher = "sha256"
+
+var hashers = map[string]Hasher{
+	"sha256":     sha256Hasher{},
+	"sha512_256": sha512256Hasher{},
+	"blake2b":    blake2bHasher{},
+	"blake3":     blake3Hasher{},
+	"xxh3":       xxh3Hasher{},
+}
+
+// NewHasher returns the Hasher for the named algorithm.
+func NewHasher(name string) (Hasher, error) {
+	if name == "" {
+		name = DefaultHasher
+	}
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown record hash algorithm '%s'", name)
+	}
+	return h, nil
+}
+
+// HasherNames lists the names of all available record hash algorithms.
+func HasherNames() []string {
+	names := make([]string, 0, len(hashers))
+	for n := range hashers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/////////
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string        { return "sha256" }
+func (sha256Hasher) Cryptographic() bool { return true }
+func (sha256Hasher) New() hash.Hash      { return sha256.New() }
+
+func (sha256Hasher) Sum256(record []byte) [sha256.Size]byte {
+	return sha256.Sum256(record)
+}
+
+/////////
+
+type sha512256Hasher struct{}
+
+func (sha512256Hasher) Name() string        { return "sha512_256" }
+func (sha512256Hasher) Cryptographic() bool { return true }
+func (sha512256Hasher) New() hash.Hash      { return sha512.New512_256() }
+
+func (sha512256Hasher) Sum256(record []byte) [sha256.Size]byte {
+	return sha512.Sum512_256(record)
+}
+
+/////////
+
+type blake2bHasher struct{}
+
+func (blake2bHasher) Name() string        { return "blake2b" }
+func (blake2bHasher) Cryptographic() bool { return true }
+
+func (blake2bHasher) New() hash.Hash {
+	// only fails for invalid keys
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+func (blake2bHasher) Sum256(record []byte) [sha256.Size]byte {
+	return blake2b.Sum256(record)
+}
+
+/////////
+
+type blake3Hasher struct{}
+
+func (blake3Hasher) Name() string        { return "blake3" }
+func (blake3Hasher) Cryptographic() bool { return true }
+func (blake3Hasher) New() hash.Hash      { return blake3.New(sha256.Size, nil) }
+
+func (blake3Hasher) Sum256(record []byte) [sha256.Size]byte {
+	return blake3.Sum256(record)
+}
+
+/////////
+
+// xxh3 is very fast but is NOT collision resistant, it should only be
+// used for integrity checks where inputs are not adversarial.
+// Two 128-bit hashes with different seeds make up the 32-byte digest.
+type xxh3Hasher struct{}
+
+const xxh3Seed2 = 0x9E3779B97F4A7C15
+
+func (xxh3Hasher) Name() string        { return "xxh3" }
+func (xxh3Hasher) Cryptographic() bool { return false }
+
+func (xxh3Hasher) New() hash.Hash {
+	return &xxh3Hash{a: xxh3.New128(), b: xxh3.NewSeed128(xxh3Seed2)}
+}
+
+func (xxh3Hasher) Sum256(record []byte) (h [sha256.Size]byte) {
+	putUint128(h[:16], xxh3.Hash128(record))
+	putUint128(h[16:], xxh3.Hash128Seed(record, xxh3Seed2))
+	return h
+}
+
+func putUint128(b []byte, u xxh3.Uint128) {
+	binary.BigEndian.PutUint64(b[:8], u.Hi)
+	binary.BigEndian.PutUint64(b[8:], u.Lo)
+}
+
+type xxh3Hash struct {
+	a, b *xxh3.Hasher128
+}
+
+func (x *xxh3Hash) Write(p []byte) (int, error) {
+	x.a.Write(p)
+	return x.b.Write(p)
+}
+
+func (x *xxh3Hash) Sum(b []byte) []byte {
+	var h [sha256.Size]byte
+	putUint128(h[:16], x.a.Sum128())
+	putUint128(h[16:], x.b.Sum128())
+	return append(b, h[:]...)
+}
+
+func (x *xxh3Hash) Reset() {
+	x.a.Reset()
+	x.b.ResetSeed(xxh3Seed2)
+}
+
+func (x *xxh3Hash) Size() int      { return sha256.Size }
+func (x *xxh3Hash) BlockSize() int { return x.a.BlockSize() }
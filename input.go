@@ -0,0 +1,360 @@
+package qcd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Stdin is the filename used to read from standard input.
+const Stdin = "-"
+
+// Input is an opened data source, decompressed if necessary.
+type Input struct {
+	io.Reader
+
+	// Name is the filename the input was opened from.
+	Name string
+
+	// Compression is the detected compression format ("gzip", "bzip2",
+	// "xz", "zstd" or "lz4"), or empty if the input was not compressed.
+	Compression string
+
+	// Archive is the detected archive format ("tar" or "zip"), or empty
+	// if the input is not an archive. Reading an archive input reads the
+	// records of all its members in turn, use Members to read them
+	// separately.
+	Archive string
+
+	// Size is the size of the (compressed) input file in bytes, or -1 if
+	// it is not known, e.g. for standard input.
+	Size int64
+
+	// the (decompressed) data, for reading archive members
+	data *bufio.Reader
+	file *os.File
+	raw  *countingReader
+	// records are fixed-length, so archive members are not separated
+	// by newlines; set by a Checksummer reading the input
+	framed bool
+
+	closers []io.Closer
+}
+
+// compression formats, identified by their magic bytes
+var compressions = []struct {
+	name  string
+	ext   string
+	magic []byte
+	open  func(r io.Reader) (io.Reader, io.Closer, error)
+}{
+	{"gzip", ".gz", []byte{0x1f, 0x8b}, openGzip},
+	{"bzip2", ".bz2", []byte("BZh"), openBzip2},
+	{"xz", ".xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, openXz},
+	{"zstd", ".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}, openZstd},
+	{"lz4", ".lz4", []byte{0x04, 0x22, 0x4d, 0x18}, openLz4},
+}
+
+// OpenInput opens a data file, or standard input if filename is Stdin
+// or empty. Compressed data and archives are detected by their content
+// rather than the filename, and decompressed transparently.
+func OpenInput(filename string) (*Input, error) {
+	if filename == "" || filename == Stdin {
+		return NewInput(os.Stdin, Stdin)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(-1)
+	if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+		size = st.Size()
+	}
+	raw := &countingReader{r: f}
+	in, err := NewInput(raw, filename)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	in.Size = size
+	in.file = f
+	in.raw = raw
+	in.closers = append(in.closers, f)
+	return in, nil
+}
+
+// Consumed returns the number of bytes read from the (compressed) input
+// file so far, which can be compared with Size to estimate progress.
+// Returns -1 if it is not known, e.g. for standard input.
+func (in *Input) Consumed() int64 {
+	if in.raw == nil {
+		return -1
+	}
+	return in.raw.n
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewInput detects whether the data read from r is compressed, and
+// returns an Input which reads the decompressed data. The caller is
+// responsible for closing r.
+func NewInput(r io.Reader, name string) (*Input, error) {
+	in := &Input{Name: name, Size: -1}
+	br := bufio.NewReader(r)
+	// errors are handled by the underlying reader
+	head, _ := br.Peek(16)
+
+	in.Reader = br
+	for _, c := range compressions {
+		if !bytes.HasPrefix(head, c.magic) {
+			continue
+		}
+		if c.name == "bzip2" && !isBzip2(head) {
+			// plain text which happens to start with "BZh"
+			break
+		}
+		zr, closer, err := c.open(br)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s data: %s", name, c.name, err.Error())
+		}
+		if closer != nil {
+			in.closers = append(in.closers, closer)
+		}
+		in.Compression = c.name
+
+		// some decoders don't report errors until the first read
+		zbr := bufio.NewReader(zr)
+		if _, err = zbr.Peek(1); err != nil && err != io.EOF {
+			in.Close()
+			return nil, fmt.Errorf("%s: invalid %s data: %s", name, c.name, err.Error())
+		}
+		in.Reader = zbr
+		br = zbr
+		break
+	}
+
+	in.data = br
+	head, _ = br.Peek(512)
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		in.Archive = "zip"
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		in.Archive = "tar"
+	}
+	if in.Archive != "" {
+		in.Reader = &memberReader{in: in}
+	}
+	return in, nil
+}
+
+// Members calls fn with the name and (decompressed) data of each
+// regular file in an archive input, in archive order. It must not be
+// used after reading from the input itself.
+func (in *Input) Members(fn func(name string, r io.Reader) error) error {
+	member := func(name string, r io.Reader) error {
+		mr, err := NewInput(r, name)
+		if err != nil {
+			return err
+		}
+		err = fn(name, mr)
+		if cerr := mr.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	switch in.Archive {
+	case "tar":
+		tr := tar.NewReader(in.data)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", in.Name, err.Error())
+			}
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				continue
+			}
+			if err = member(hdr.Name, tr); err != nil {
+				return err
+			}
+		}
+
+	case "zip":
+		zr, err := in.zipReader()
+		if err != nil {
+			return fmt.Errorf("%s: %s", in.Name, err.Error())
+		}
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return fmt.Errorf("%s: %s: %s", in.Name, zf.Name, err.Error())
+			}
+			err = member(zf.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not an archive", in.Name)
+}
+
+// zipReader opens a zip archive input. Zip archives need random access,
+// so are read into memory if they are compressed or from standard input.
+func (in *Input) zipReader() (*zip.Reader, error) {
+	if in.file != nil && in.Compression == "" {
+		st, err := in.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return zip.NewReader(in.file, st.Size())
+	}
+	b, err := ioutil.ReadAll(in.data)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(b), int64(len(b)))
+}
+
+// memberReader reads the records of every member of an archive in turn.
+type memberReader struct {
+	in *Input
+	pr *io.PipeReader
+}
+
+func (m *memberReader) Read(p []byte) (int, error) {
+	if m.pr == nil {
+		var pw *io.PipeWriter
+		m.pr, pw = io.Pipe()
+		m.in.closers = append(m.in.closers, m.pr)
+		go func() {
+			pw.CloseWithError(m.in.Members(func(name string, r io.Reader) error {
+				return copyRecords(pw, r, m.in.framed)
+			}))
+		}()
+	}
+	return m.pr.Read(p)
+}
+
+// copyRecords copies r to w, adding a final newline if it is missing
+// so that records from consecutive members are not joined together.
+// Fixed-length records are copied as they are.
+func copyRecords(w io.Writer, r io.Reader, framed bool) error {
+	if framed {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	lw := &lastByteWriter{w: w}
+	n, err := io.Copy(lw, r)
+	if err == nil && n > 0 && lw.last != '\n' {
+		_, err = w.Write([]byte{'\n'})
+	}
+	return err
+}
+
+type lastByteWriter struct {
+	w    io.Writer
+	last byte
+}
+
+func (lw *lastByteWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		lw.last = p[len(p)-1]
+	}
+	return lw.w.Write(p)
+}
+
+// Close closes the input and any decompressor.
+func (in *Input) Close() error {
+	var err error
+	for _, c := range in.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	in.closers = nil
+	return err
+}
+
+// TrimCompressionExt returns the filename without a compression
+// extension (".gz", ".bz2", ".xz", ".zst" or ".lz4"), if it has one.
+func TrimCompressionExt(filename string) string {
+	for _, c := range compressions {
+		if strings.HasSuffix(filename, c.ext) {
+			return strings.TrimSuffix(filename, c.ext)
+		}
+	}
+	return filename
+}
+
+// isBzip2 checks the block size and first block (or end of stream) magic
+// of a bzip2 header, since "BZh" alone could easily be text.
+func isBzip2(head []byte) bool {
+	if len(head) < 10 || head[3] < '1' || head[3] > '9' {
+		return false
+	}
+	return bytes.Equal(head[4:10], []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}) ||
+		bytes.Equal(head[4:10], []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90})
+}
+
+func openGzip(r io.Reader) (io.Reader, io.Closer, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	// concatenated gzip members (e.g. from parallel compressors or
+	// appended log files) are read as a single stream
+	zr.Multistream(true)
+	return zr, zr, nil
+}
+
+func openBzip2(r io.Reader) (io.Reader, io.Closer, error) {
+	return bzip2.NewReader(r), nil, nil
+}
+
+func openXz(r io.Reader) (io.Reader, io.Closer, error) {
+	zr, err := xz.NewReader(r)
+	return zr, nil, err
+}
+
+func openZstd(r io.Reader) (io.Reader, io.Closer, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc := zr.IOReadCloser()
+	return rc, rc, nil
+}
+
+func openLz4(r io.Reader) (io.Reader, io.Closer, error) {
+	return lz4.NewReader(r), nil, nil
+}
@@ -0,0 +1,67 @@
+package qcd
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestArchiveFixedLength(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range []struct{ name, data string }{
+		{"a.dat", "01aaaa02b\nbb"},
+		{"b.dat", "03cccc"},
+	} {
+		tw.WriteHeader(&tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data))})
+		tw.Write([]byte(m.data))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	newCk := func() *Checksummer {
+		ck := &Checksummer{}
+		ck.SetLayout(&Layout{
+			RecordLength: 6,
+			Fields:       []LayoutField{{Name: "id", Offset: 0, Length: 2}, {Name: "v", Offset: 2, Length: 4}},
+		})
+		return ck
+	}
+	want := newCk()
+	if err := want.Sum(strings.NewReader("01aaaa02b\nbb03cccc")); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := NewInput(bytes.NewReader(buf.Bytes()), "test.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Archive != "tar" {
+		t.Fatalf("archive = %q, want tar", in.Archive)
+	}
+	ck := newCk()
+	if err = ck.Sum(in); err != nil {
+		t.Fatal(err)
+	}
+	in.Close()
+	if ck.Records() != 3 {
+		t.Errorf("%d records, want 3", ck.Records())
+	}
+	if got, want := ck.Info()["content_hash"], want.Info()["content_hash"]; got != want {
+		t.Errorf("content_hash = %s, want %s", got, want)
+	}
+
+	in, err = NewInput(bytes.NewReader(buf.Bytes()), "test.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	ok, nbad, err := (&Checksummer{}).Verify(in, want.Info())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || nbad != 0 {
+		t.Errorf("Verify = %v, %d unverified, want true, 0", ok, nbad)
+	}
+}
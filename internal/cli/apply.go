@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/joiningdata/qcd"
+)
+
+// applyMain implements "qcd apply base_file patch_file", which writes the
+// patched records to standard output (or -o) and verifies them against
+// the patch's expected content hash.
+func applyMain(args []string) int {
+	fs := newFlagSet("apply", "base_file patch_file")
+	res := addJSONFlag(fs)
+	outfile := fs.String("o", "", "write patched records to `filename` instead of standard output (required with --json)")
+	keyfile := fs.String("k", "", "secret key `filename` for keyed record hashing (or set $QCD_KEY)")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return res.exit(exitUsage)
+	}
+	if res.json && *outfile == "" {
+		return res.fail(exitUsage, "--json requires -o, as the result is printed to standard output")
+	}
+
+	key, err := readKey(*keyfile)
+	if err != nil {
+		return res.fail(exitUsage, "Unable to read key: -k '%s'\n    %s", *keyfile, err.Error())
+	}
+	res.Input = fs.Arg(0)
+	res.Patch = fs.Arg(1)
+
+	pf, err := os.Open(fs.Arg(1))
+	if err != nil {
+		return res.fail(exitIO, "Error opening patch file: %s", err.Error())
+	}
+	p, err := qcd.ReadPatch(pf)
+	pf.Close()
+	if err != nil {
+		return res.fail(exitBadManifest, "Error reading patch file: %s", describeError(err))
+	}
+
+	var out io.Writer = os.Stdout
+	if *outfile != "" {
+		f, err := os.Create(*outfile)
+		if err != nil {
+			return res.fail(exitIO, "Error creating output file: %s", err.Error())
+		}
+		res.atExit(f.Close)
+		res.Output = *outfile
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	err = p.ApplyFile(fs.Arg(0), w, key)
+	if ferr := w.Flush(); err == nil && ferr != nil {
+		err = ferr
+	}
+	if err != nil {
+		return res.fail(exitFor(err), "PATCH FAILED: %s", describeError(err))
+	}
+	fmt.Fprintln(os.Stderr, "PATCH OK")
+	return res.exit(exitOK)
+}
@@ -0,0 +1,366 @@
+// Package cli implements the qcd and qcdiff commands.
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joiningdata/qcd"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"sum", "checksum a data file, archive or directory and write its manifest", sumMain},
+	{"verify", "verify a data file, archive or directory against its manifest", verifyMain},
+	{"info", "decode and describe manifests", infoMain},
+	{"inspect", "same as info", infoMain},
+	{"diff", "compare the records of two data files", func(args []string) int {
+		return DiffMain("qcd diff", args)
+	}},
+	{"merge", "three-way merge of the records of data files", mergeMain},
+	{"apply", "apply a patch created by qcd diff -o", applyMain},
+}
+
+// Main runs the qcd command with the given command line, and returns
+// its exit status. Command lines without a subcommand use the original
+// flag-based interface, see legacyMain.
+func Main(args []string) int {
+	if len(args) > 1 {
+		switch name := args[1]; name {
+		case "help", "-h", "-help", "--help":
+			usage(os.Stdout)
+			return exitOK
+		case "merge3":
+			// original name of the merge subcommand
+			return mergeMain(args[2:])
+		default:
+			for _, c := range commands {
+				if c.name == name {
+					return c.run(args[2:])
+				}
+			}
+		}
+	}
+	return legacyMain(args[1:])
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "USAGE: %s <command> [options] [arguments]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, c := range commands {
+		fmt.Fprintf(w, "    %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nUse '%s <command> -h' for the options of each command.\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprint(w, exitStatusHelp)
+}
+
+// newFlagSet creates a FlagSet for a subcommand with a usage line.
+func newFlagSet(name, arguments string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s %s [options] %s\n", filepath.Base(os.Args[0]), name, arguments)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses a subcommand's arguments. If the command should
+// exit immediately (e.g. for -h), returns false with the exit status.
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return exitOK, false
+	}
+	if err != nil {
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// addJSONFlag adds the --json flag to a subcommand, and returns its result.
+func addJSONFlag(fs *flag.FlagSet) *result {
+	res := &result{Command: fs.Name()}
+	fs.BoolVar(&res.json, "json", false, "print the result as a JSON object to standard output")
+	return res
+}
+
+// hashOptions are the flags which configure how records are hashed.
+type hashOptions struct {
+	verbose   *bool
+	regex     *string
+	repl      *string
+	zsize     *string
+	halg      *string
+	keyfile   *string
+	maxRec    *int
+	lines     *string
+	recFormat *string
+	jsonInc   *string
+	jsonExc   *string
+	layoutf   *string
+	fldInc    *string
+	fldMask   *string
+
+	key    []byte
+	layout *qcd.Layout
+}
+
+func addHashFlags(fs *flag.FlagSet) *hashOptions {
+	return &hashOptions{
+		verbose:   fs.Bool("e", false, "enable verbose errors"),
+		regex:     fs.String("r", "", "`regex` to mask unstable content (e.g. dates, offsets, etc.)"),
+		repl:      fs.String("x", "", "`text` to use for masked content"),
+		zsize:     fs.String("z", "*", "estimated data size (0, S, M, L)"),
+		halg:      fs.String("a", qcd.DefaultHasher, "record hash `algorithm` ("+strings.Join(qcd.HasherNames(), ", ")+")"),
+		keyfile:   fs.String("k", "", "secret key `filename` for keyed record hashing (or set $QCD_KEY)"),
+		maxRec:    addMaxRecordFlag(fs),
+		lines:     fs.String("line-mode", "", "how lines are split into records: exact (byte-exact, including line endings) or canonical (ignoring a BOM, CRLF, final newline and trailing blank lines)"),
+		recFormat: fs.String("record-format", "text", "record `format`: text, or json to checksum the canonical form (RFC 8785) of each JSON record"),
+		jsonInc:   fs.String("json-include", "", "comma-separated JSON `pointers` to the values of each record to checksum (with -record-format json)"),
+		jsonExc:   fs.String("json-exclude", "", "comma-separated JSON `pointers` to values to ignore in each record (with -record-format json)"),
+		layoutf:   fs.String("layout", "", "fixed-width record layout `filename`, with a 'name [offset] length' line per field and an optional 'record_length n' line for records without newlines"),
+		fldInc:    fs.String("layout-include", "", "comma-separated `fields` of the -layout to checksum (default all)"),
+		fldMask:   fs.String("layout-mask", "", "comma-separated `fields` of the -layout to ignore"),
+	}
+}
+
+// addSourceFlags adds the hash flags to a command which compares data
+// files. They are used to checksum files without a .qcd file, except
+// -r and -x, which set a common mask overriding the files' own masks.
+func addSourceFlags(fs *flag.FlagSet) *hashOptions {
+	o := addHashFlags(fs)
+	fs.Lookup("r").Usage = "`regex` to mask unstable content, overrides the mask used by the files"
+	fs.Lookup("a").Usage = "record hash `algorithm` for files without a .qcd file (" + strings.Join(qcd.HasherNames(), ", ") + ")"
+	return o
+}
+
+// sourceOptions returns the options for opening data sources with the
+// hash flags added by addSourceFlags, which must have been checked by setup.
+func (o *hashOptions) sourceOptions() []qcd.SourceOption {
+	opts := []qcd.SourceOption{
+		qcd.WithKey(o.key),
+		qcd.WithoutCheckFile(),
+		qcd.WithHasher(*o.halg),
+		qcd.WithMaxRecordLength(*o.maxRec),
+		qcd.WithLineMode(qcd.LineMode(*o.lines)),
+		qcd.WithJSON(o.jsonOptions()),
+		qcd.WithLayout(o.layout),
+	}
+	if *o.regex != "" {
+		opts = append(opts, qcd.WithCommonMask(*o.regex, *o.repl))
+	}
+	return opts
+}
+
+// jsonOptions returns the JSON record format options, or nil if the
+// records are text.
+func (o *hashOptions) jsonOptions() *qcd.JSONOptions {
+	if *o.recFormat != "json" {
+		return nil
+	}
+	opts := &qcd.JSONOptions{}
+	if *o.jsonInc != "" {
+		opts.Include = strings.Split(*o.jsonInc, ",")
+	}
+	if *o.jsonExc != "" {
+		opts.Exclude = strings.Split(*o.jsonExc, ",")
+	}
+	return opts
+}
+
+// describeError returns an error message, with a hint on how to fix
+// errors caused by the options.
+func describeError(err error) string {
+	var tl *qcd.RecordTooLongError
+	if errors.As(err, &tl) {
+		return err.Error() + "\n    use -max-record to allow longer records"
+	}
+	var mm *qcd.MaskMismatchError
+	if errors.As(err, &mm) {
+		return err.Error() + "\n    use -r and -x to set a common mask"
+	}
+	var re *qcd.RecordError
+	if errors.As(err, &re) {
+		return err.Error() + "\n    the data does not match the record format (see -record-format and -layout)"
+	}
+	return err.Error()
+}
+
+// addMaxRecordFlag adds the -max-record flag for SetMaxRecordLength.
+func addMaxRecordFlag(fs *flag.FlagSet) *int {
+	return fs.Int("max-record", 0, fmt.Sprintf("longest record in `bytes`, or -1 for no limit (long records are hashed as they are read); "+
+		"0 uses the limit stored in the checksum file, or %d", qcd.DefaultMaxRecordLength))
+}
+
+// setup reads the key and checks the options. Returns an error message
+// suitable for printing if they are invalid.
+func (o *hashOptions) setup() error {
+	var err error
+	o.key, err = readKey(*o.keyfile)
+	if err != nil {
+		return fmt.Errorf("Unable to read key: -k '%s'\n    %s", *o.keyfile, err.Error())
+	}
+	if *o.zsize != "" {
+		qcd.DefaultSumSize = qcd.QuickSumSize((*o.zsize)[0])
+	}
+
+	ck := &qcd.Checksummer{}
+	err = ck.SetHasher(*o.halg)
+	if err == nil {
+		err = ck.SetKey(o.key)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid hash options: -a '%s'\n    %s", *o.halg, err.Error())
+	}
+	if err = ck.SetLineMode(qcd.LineMode(*o.lines)); err != nil {
+		return fmt.Errorf("Invalid line mode: -line-mode '%s'\n    %s", *o.lines, err.Error())
+	}
+	switch *o.recFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("Invalid record format: -record-format '%s'\n    must be text or json", *o.recFormat)
+	}
+	if *o.recFormat != "json" && (*o.jsonInc != "" || *o.jsonExc != "") {
+		return fmt.Errorf("-json-include and -json-exclude require -record-format json")
+	}
+	if err = ck.SetJSON(o.jsonOptions()); err != nil {
+		return fmt.Errorf("Invalid JSON options:\n    %s", err.Error())
+	}
+	if *o.layoutf == "" && (*o.fldInc != "" || *o.fldMask != "") {
+		return fmt.Errorf("-layout-include and -layout-mask require a -layout")
+	}
+	if *o.layoutf != "" {
+		o.layout, err = qcd.ReadLayout(*o.layoutf)
+		if err != nil {
+			return fmt.Errorf("Unable to read layout: -layout '%s'\n    %s", *o.layoutf, err.Error())
+		}
+		if *o.fldInc != "" {
+			o.layout.Include = strings.Split(*o.fldInc, ",")
+		}
+		if *o.fldMask != "" {
+			o.layout.Mask = strings.Split(*o.fldMask, ",")
+		}
+		if err = ck.SetLayout(o.layout); err != nil {
+			return fmt.Errorf("Invalid layout: -layout '%s'\n    %s", *o.layoutf, err.Error())
+		}
+	}
+	if *o.regex != "" {
+		if err = ck.SetRegex(*o.regex, *o.repl); err != nil {
+			return fmt.Errorf("Invalid Regex: -r '%s'\n    %s", *o.regex, err.Error())
+		}
+	}
+	return nil
+}
+
+// newChecksummer creates a Checksummer with the options, which must
+// have been checked by setup.
+func (o *hashOptions) newChecksummer() *qcd.Checksummer {
+	ck := &qcd.Checksummer{}
+	ck.SetHasher(*o.halg)
+	ck.SetKey(o.key)
+	ck.SetMaxRecordLength(*o.maxRec)
+	ck.SetLineMode(qcd.LineMode(*o.lines))
+	ck.SetJSON(o.jsonOptions())
+	ck.SetLayout(o.layout)
+	if *o.regex != "" {
+		ck.SetRegex(*o.regex, *o.repl)
+	}
+	if *o.verbose {
+		ck.SetVerbose(os.Stderr)
+	}
+	return ck
+}
+
+// manifestName returns the manifest filename for a data file, replacing
+// %s in the pattern with the data filename (without any compression
+// extension). A leading %s is replaced with the full path, otherwise
+// just the base name is used. Returns "" if the pattern needs a name
+// but the data is read from standard input.
+func manifestName(pattern, filename string) string {
+	if !strings.Contains(pattern, "%s") {
+		return pattern
+	}
+	if filename == "" || filename == qcd.Stdin {
+		return ""
+	}
+	fn := qcd.TrimCompressionExt(filename)
+	if strings.HasPrefix(pattern, "%s") {
+		return fn + strings.TrimPrefix(pattern, "%s")
+	}
+	return fmt.Sprintf(pattern, filepath.Base(fn))
+}
+
+// openInput opens a data file, or standard input for "" or "-".
+func openInput(fn string, verbose bool) (*qcd.Input, error) {
+	if fn == "" || fn == qcd.Stdin {
+		fmt.Fprintln(os.Stderr, "Reading from standard input...")
+	}
+	src, err := qcd.OpenInput(fn)
+	if err != nil {
+		return nil, err
+	}
+	if src.Compression != "" && verbose {
+		fmt.Fprintf(os.Stderr, "Reading %s compressed data\n", src.Compression)
+	}
+	return src, nil
+}
+
+// writeManifest writes a manifest to the named file, or to standard
+// output for "-".
+func writeManifest(m *qcd.Manifest, vfile string) error {
+	if vfile == qcd.Stdin {
+		fmt.Fprintln(os.Stderr, "Writing verification data to standard output")
+		_, err := m.WriteTo(os.Stdout)
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Writing verification data to", vfile)
+	return m.WriteFile(vfile)
+}
+
+// sourceName returns the logical name of an input, which for standard
+// input is the --stdin-name (if given).
+func sourceName(src *qcd.Input, stdinName string) string {
+	if src.Name == qcd.Stdin && stdinName != "" {
+		return stdinName
+	}
+	return src.Name
+}
+
+// printInfo prints checksum information, abbreviating long values.
+func printInfo(info map[string]string) {
+	for key, val := range info {
+		if len(val) > 100 {
+			val = val[:50] + "..." + val[len(val)-50:]
+		}
+		fmt.Fprintf(os.Stderr, "%-20s: %s\n", key, val)
+	}
+}
+
+// readKey loads the secret key for keyed record hashing from the
+// named file, or from the QCD_KEY environment variable if no
+// filename is given. Surrounding whitespace is ignored.
+func readKey(filename string) ([]byte, error) {
+	if filename == "" {
+		return []byte(strings.TrimSpace(os.Getenv("QCD_KEY"))), nil
+	}
+	kb, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	kb = bytes.TrimSpace(kb)
+	if len(kb) == 0 {
+		return nil, fmt.Errorf("key file is empty")
+	}
+	return kb, nil
+}
@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joiningdata/qcd"
+)
+
+// sumDir implements "qcd sum -R dir", which checksums every file in a
+// directory tree and writes a single manifest. Returns the exit status.
+func sumDir(res *result, dir, vfile string, newChecksummer func() *qcd.Checksummer, workers int) int {
+	if dir == "" {
+		return res.fail(exitUsage, "-R requires a directory")
+	}
+	dir = strings.TrimRight(dir, "/")
+	if strings.Contains(vfile, "%s") {
+		if strings.HasPrefix(vfile, "%s") {
+			vfile = dir + strings.TrimPrefix(vfile, "%s")
+		} else {
+			vfile = fmt.Sprintf(vfile, filepath.Base(dir))
+		}
+	}
+	if vfile == "" {
+		return res.fail(exitUsage, "-R requires a manifest filename")
+	}
+	res.Input = dir
+	res.Manifest = vfile
+
+	// names in the manifest are relative to its own directory, so that
+	// both can be moved together
+	base, err := filepath.Abs(filepath.Dir(vfile))
+	if err != nil {
+		return res.fail(exitIO, "Error reading directory: %s", err.Error())
+	}
+	var names []string
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasSuffix(path, ".qcd") {
+			return nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, abs)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return res.fail(exitIO, "Error reading directory: %s", err.Error())
+	}
+	if len(names) == 0 {
+		return res.fail(exitIO, "No files found in %s", dir)
+	}
+
+	fmt.Fprintf(os.Stderr, "Checksumming %d files in %s\n", len(names), dir)
+	files := make(map[string]map[string]string)
+	nerr := 0
+	for _, fr := range qcd.SumFiles(base, names, newChecksummer, workers) {
+		if fr.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", fr.Name, fr.Err.Error())
+			res.Files = append(res.Files, fileResult{Name: fr.Name, Status: statusNames[exitIO],
+				Error: fr.Err.Error()})
+			nerr++
+			continue
+		}
+		files[fr.Name] = fr.Info
+		res.Files = append(res.Files, fileResult{Name: fr.Name, Status: statusNames[exitOK],
+			Info: fr.Info})
+	}
+	if nerr > 0 {
+		return res.fail(exitIO, "%d of %d files could not be read, no manifest written", nerr, len(names))
+	}
+
+	manifest, err := qcd.NewManifest(files)
+	if err != nil {
+		return res.fail(exitIO, "an error occured: %s", err.Error())
+	}
+	res.Info = manifest.Dataset
+	if err = writeManifest(manifest, vfile); err != nil {
+		return res.fail(exitIO, "error writing verification file: %s", err.Error())
+	}
+	printInfo(manifest.Dataset)
+	return res.exit(exitOK)
+}
+
+// checkManifest implements "qcd verify -c manifest", which verifies every
+// file listed in the manifest and prints a line for each to standard
+// output (unless --json was given), in the style of sha256sum -c.
+func checkManifest(res *result, filename string, key []byte, workers int) int {
+	res.Manifest = filename
+	manifest, err := qcd.ReadManifest(filename)
+	if err != nil {
+		return res.fail(exitFor(err), "Unable to verify: -c '%s'\n    %s", filename, err.Error())
+	}
+	if manifest.Files == nil {
+		return res.fail(exitBadManifest, "Unable to verify: -c '%s'\n    manifest does not list any files", filename)
+	}
+
+	status := exitOK
+	nbad := 0
+	results := manifest.VerifyFiles(filepath.Dir(filename), key, workers)
+	for _, fr := range results {
+		var line string
+		fstatus := verifyStatus(fr.OK, fr.Unverified)
+		switch {
+		case fr.Err != nil:
+			fstatus = exitFor(fr.Err)
+			line = fmt.Sprintf("%s: FAILED open or read (%s)", fr.Name, fr.Err.Error())
+		case !fr.OK:
+			line = fmt.Sprintf("%s: FAILED (%d records unverified)", fr.Name, fr.Unverified)
+		default:
+			line = fmt.Sprintf("%s: OK", fr.Name)
+		}
+		if !res.json {
+			fmt.Println(line)
+		}
+
+		r := fileResult{Name: fr.Name, Status: statusNames[fstatus], Unverified: fr.Unverified}
+		if fr.Err != nil {
+			r.Error = fr.Err.Error()
+		}
+		res.Files = append(res.Files, r)
+		res.Unverified += fr.Unverified
+		status = worse(status, fstatus)
+		if fstatus != exitOK {
+			nbad++
+		}
+	}
+	if nbad > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d of %d files FAILED\n", nbad, len(results))
+	}
+	return res.exit(status)
+}
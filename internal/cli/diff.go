@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/joiningdata/qcd"
+)
+
+// DiffMain implements "qcd diff" and the qcdiff command, which compares
+// the records of two data files. prog is the command name for usage
+// messages. Returns the exit status: exitOK if the files have the same
+// records, or exitMismatch if they differ.
+func DiffMain(prog string, args []string) int {
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s [options] base_file test_file\n", prog)
+		fs.PrintDefaults()
+	}
+	res := addJSONFlag(fs)
+	res.Command = "diff"
+	hopts := addSourceFlags(fs)
+	stream := fs.Bool("s", false, "always use the streaming diff (unordered, bounded memory)")
+	tmpdir := fs.String("T", "", "`directory` for streaming diff temporary files")
+	keycols := fs.String("key", "", "comma-separated key `columns` (names or numbers) to match rows of delimited data")
+	delim := fs.String("d", ",", "field `delimiter` for -key (use \\t for tabs)")
+	header := fs.Bool("header", false, "first record is a header row (for -key)")
+	format := fs.String("format", "text", "output `format`: text, jsonl, csv or html (text, json or csv with -key)")
+	summaryOnly := fs.Bool("summary-only", false, "only print a summary of the differences")
+	patchfile := fs.String("o", "", "write a patch (edit script) to `filename` instead of a diff")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+
+	fn1 := fs.Arg(0)
+	fn2 := fs.Arg(1)
+	if fn1 == "" || fn2 == "" || fs.NArg() > 2 {
+		fs.Usage()
+		return res.exit(exitUsage)
+	}
+	if *keycols != "" {
+		if *summaryOnly {
+			return res.fail(exitUsage, "-summary-only cannot be used with -key")
+		}
+		switch *format {
+		case "text", "json", "csv":
+		default:
+			return res.fail(exitUsage, "unknown output format '%s' for -key", *format)
+		}
+	}
+	if err := hopts.setup(); err != nil {
+		return res.fail(exitUsage, "%s", err.Error())
+	}
+	opts := hopts.sourceOptions()
+	res.Inputs = []string{fn1, fn2}
+
+	// with --json, the result is printed instead of the differences
+	var stdout io.Writer = os.Stdout
+	if res.json {
+		stdout = ioutil.Discard
+	}
+	out := bufio.NewWriter(stdout)
+	var same bool
+	var err error
+	var summary string
+	if *patchfile != "" {
+		res.Patch = *patchfile
+		res.Diff, err = writePatch(fn1, fn2, opts, *patchfile)
+		same = err == nil && res.Diff.Same()
+	} else if *keycols != "" {
+		same, err = keyDiff(fn1, fn2, opts, *keycols, *delim, *header, *format, out)
+	} else {
+		var sink qcd.DiffSink = qcd.DiscardDiffSink
+		if !*summaryOnly {
+			sink, err = newSink(*format, out, fn1+" vs "+fn2)
+			if err != nil {
+				return res.fail(exitUsage, "%s", err.Error())
+			}
+		}
+		var sum qcd.DiffSummary
+		sd := &qcd.StreamDiff{TempDir: *tmpdir, Key: hopts.key,
+			CommonMask: *hopts.regex, CommonReplacement: *hopts.repl,
+			NewChecksummer: hopts.newChecksummer}
+		if *stream || isLarge(sd, fn1, fn2) {
+			sum, err = sd.DiffTo(fn1, fn2, sink)
+		} else {
+			sum, err = recordDiff(fn1, fn2, opts, sink)
+		}
+		if err == nil {
+			res.Diff = &sum
+			if *summaryOnly {
+				fmt.Fprintln(out, sum)
+			} else {
+				summary = sum.String()
+			}
+		}
+		same = sum.Same()
+	}
+	if ferr := out.Flush(); err == nil && ferr != nil {
+		err = ferr
+	}
+	if summary != "" {
+		fmt.Fprintln(os.Stderr, summary)
+	}
+	if err != nil {
+		return res.fail(exitFor(err), "%s", describeError(err))
+	}
+	if !same {
+		return res.exit(exitMismatch)
+	}
+	return res.exit(exitOK)
+}
+
+// newSink creates a DiffSink for the named output format.
+func newSink(format string, w io.Writer, title string) (qcd.DiffSink, error) {
+	switch format {
+	case "text":
+		return qcd.NewTextDiffSink(w), nil
+	case "jsonl":
+		return qcd.NewJSONLinesDiffSink(w), nil
+	case "csv":
+		return qcd.NewCSVDiffSink(w), nil
+	case "html":
+		return qcd.NewHTMLDiffSink(w, title), nil
+	}
+	return nil, fmt.Errorf("unknown output format '%s'", format)
+}
+
+// recordDiff compares two sources in memory, preserving record order.
+func recordDiff(fn1, fn2 string, opts []qcd.SourceOption, sink qcd.DiffSink) (qcd.DiffSummary, error) {
+	left, right, err := qcd.NewSourcePair(fn1, fn2, opts...)
+	if err != nil {
+		return qcd.DiffSummary{}, err
+	}
+	return left.Diff(right, sink)
+}
+
+// writePatch writes a patch that turns the records of fn1 into fn2.
+// Returns the number of records it adds and removes.
+func writePatch(fn1, fn2 string, opts []qcd.SourceOption, patchfile string) (*qcd.DiffSummary, error) {
+	left, right, err := qcd.NewSourcePair(fn1, fn2, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p, err := left.MakePatch(right)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(patchfile)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Writing patch to %s: %d additions, %d deletions\n", patchfile, len(p.Add), len(p.Delete))
+	return &qcd.DiffSummary{Added: len(p.Add), Removed: len(p.Delete)}, nil
+}
+
+// keyDiff compares two sources of delimited data by key.
+func keyDiff(fn1, fn2 string, opts []qcd.SourceOption, keycols, delim string, header bool, format string, w io.Writer) (bool, error) {
+	left, right, err := qcd.NewSourcePair(fn1, fn2, opts...)
+	if err != nil {
+		return false, err
+	}
+
+	kopts := qcd.KeyDiffOptions{
+		Columns: strings.Split(keycols, ","),
+		Header:  header,
+	}
+	if delim == "\\t" {
+		kopts.Delimiter = '\t'
+	} else if delim != "" {
+		kopts.Delimiter = []rune(delim)[0]
+	}
+	res, err := left.DiffByKey(right, kopts)
+	if err != nil {
+		return false, err
+	}
+	res.WriteWarnings(os.Stderr)
+	switch format {
+	case "text":
+		err = res.WriteText(w)
+	case "json":
+		err = res.WriteJSON(w)
+	case "csv":
+		err = res.WriteCSV(w)
+	default:
+		err = fmt.Errorf("unknown output format '%s' for -key", format)
+	}
+	return res.Same(), err
+}
+
+// inputs with a combined size above this will use the streaming diff
+const largeInputSize = 1 << 30
+
+// isLarge returns true if the files are too large to diff in memory, and
+// can be compared by the streaming diff: they have .qcd files, or sd can
+// compute their checksum information.
+func isLarge(sd *qcd.StreamDiff, filenames ...string) bool {
+	var total int64
+	for _, fn := range filenames {
+		st, err := os.Stat(fn)
+		if err != nil {
+			return false
+		}
+		total += st.Size()
+		if sd.NewChecksummer == nil {
+			if _, err = os.Stat(manifestName("%s.qcd", fn)); err != nil {
+				return false
+			}
+		}
+	}
+	return total > largeInputSize
+}
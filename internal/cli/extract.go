@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/joiningdata/qcd"
+)
+
+// extractor writes unverified records verbatim to a file, with the line
+// terminators or fixed-length framing of the input, for
+// --extract-unverified.
+type extractor struct {
+	filename string
+	f        *os.File
+	w        *bufio.Writer
+	err      error
+
+	records int
+	// records which were too long to hold in memory
+	skipped int
+}
+
+func newExtractor(filename string) (*extractor, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &extractor{filename: filename, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// wrap returns a newChecksummer function which passes the unverified
+// records of each Checksummer it creates to the extractor.
+func (x *extractor) wrap(newChecksummer func() *qcd.Checksummer) func() *qcd.Checksummer {
+	return func() *qcd.Checksummer {
+		ck := newChecksummer()
+		ck.SetUnverified(x.record)
+		return ck
+	}
+}
+
+func (x *extractor) record(u qcd.UnverifiedRecord) {
+	if u.Record == nil {
+		fmt.Fprintf(os.Stderr, "WARNING: unverified record at line %d is too long to extract (%d bytes)\n",
+			u.Line, u.Length)
+		x.skipped++
+		return
+	}
+	if x.err != nil {
+		return
+	}
+	_, x.err = x.w.Write(u.Record)
+	if u.Terminated {
+		// the line terminator is only included with -line-mode exact
+		x.w.WriteByte('\n')
+	}
+	x.records++
+}
+
+// Close flushes and closes the file, and reports how many records were
+// written.
+func (x *extractor) Close() error {
+	if err := x.w.Flush(); x.err == nil {
+		x.err = err
+	}
+	if err := x.f.Close(); x.err == nil {
+		x.err = err
+	}
+	if x.err != nil {
+		return x.err
+	}
+	fmt.Fprintf(os.Stderr, "Extracted %d unverified records to %s\n", x.records, x.filename)
+	return nil
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/joiningdata/qcd"
+)
+
+// manifestInfo is a decoded manifest, printed as one JSON object per
+// manifest with --json.
+type manifestInfo struct {
+	Manifest string                            `json:"manifest"`
+	Status   string                            `json:"status"`
+	ExitCode int                               `json:"exit_code"`
+	Error    string                            `json:"error,omitempty"`
+	Dataset  map[string]interface{}            `json:"dataset,omitempty"`
+	Files    map[string]map[string]interface{} `json:"files,omitempty"`
+}
+
+// infoMain implements "qcd info" (or "qcd inspect"), which decodes and
+// describes manifests, including how full each records_hash filter is.
+func infoMain(args []string) int {
+	fs := newFlagSet("info", "manifest...")
+	jsonOut := fs.Bool("json", false, "print each manifest as a JSON object to standard output")
+	files := fs.Bool("f", false, "describe each file of a directory or archive manifest")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	status := exitOK
+	for i, name := range fs.Args() {
+		if i > 0 && !*jsonOut {
+			fmt.Println()
+		}
+		mi := &manifestInfo{Manifest: name}
+		mstatus := describeManifest(mi, *files, *jsonOut)
+		status = worse(status, mstatus)
+		mi.ExitCode, mi.Status = mstatus, statusNames[mstatus]
+		if *jsonOut {
+			json.NewEncoder(os.Stdout).Encode(mi)
+		}
+	}
+	return status
+}
+
+// describeManifest reads and decodes a manifest. Unless jsonOut, it is
+// also described on standard output. Returns the exit status.
+func describeManifest(mi *manifestInfo, files, jsonOut bool) int {
+	m, err := qcd.ReadManifest(mi.Manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read manifest: '%s'\n    %s\n", mi.Manifest, err.Error())
+		mi.Error = err.Error()
+		return exitFor(err)
+	}
+
+	w := io.Discard
+	if !jsonOut {
+		w = os.Stdout
+	}
+	fmt.Fprintf(w, "%s:\n", mi.Manifest)
+	mi.Dataset, err = describeInfo(w, "    ", m.Dataset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", mi.Manifest, err.Error())
+		mi.Error = err.Error()
+		return exitBadManifest
+	}
+	if m.Files == nil {
+		return exitOK
+	}
+
+	names := make([]string, 0, len(m.Files))
+	for fn := range m.Files {
+		names = append(names, fn)
+	}
+	sort.Strings(names)
+	mi.Files = make(map[string]map[string]interface{})
+	for _, fn := range names {
+		fw := w
+		if files {
+			fmt.Fprintf(w, "    %s:\n", fn)
+		} else {
+			fmt.Fprintf(w, "    %s: %s records\n", fn, m.Files[fn]["total_records"])
+			fw = io.Discard
+		}
+		mi.Files[fn], err = describeInfo(fw, "        ", m.Files[fn])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", mi.Manifest, fn, err.Error())
+			mi.Error = err.Error()
+			return exitBadManifest
+		}
+	}
+	return exitOK
+}
+
+// recordsHashInfo describes a records_hash filter in JSON output.
+type recordsHashInfo struct {
+	*qcd.RecordsHashInfo
+	Size      string  `json:"size"`
+	FillRatio float64 `json:"fill_ratio"`
+}
+
+// describeInfo writes checksum information in sorted order, replacing
+// the records_hash with a description of its filter. Returns the
+// information with the records_hash decoded.
+func describeInfo(w io.Writer, indent string, info map[string]string) (map[string]interface{}, error) {
+	keys := make([]string, 0, len(info))
+	for k := range info {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	decoded := make(map[string]interface{}, len(info))
+	for _, k := range keys {
+		val := info[k]
+		decoded[k] = val
+		if k == "records_hash" {
+			rh, err := qcd.InspectRecordsHash(val)
+			if err != nil {
+				return nil, err
+			}
+			decoded[k] = recordsHashInfo{rh, string(rh.Size), rh.FillRatio()}
+			val = fmt.Sprintf("%c filter, %d bits, %d keys per record, %.2f%% full",
+				rh.Size, rh.Bits, rh.Keys, 100*rh.FillRatio())
+		}
+		fmt.Fprintf(w, "%s%-20s: %s\n", indent, k, val)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/joiningdata/qcd"
+)
+
+// legacyMain implements the original qcd interface, used when no
+// subcommand is given: a data file is verified if its manifest (-v)
+// exists, and checksummed otherwise. Use "qcd sum" or "qcd verify" to
+// be explicit.
+func legacyMain(args []string) int {
+	fs := newFlagSet("", "[data_file]")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s [options] [data_file]\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintln(os.Stderr)
+		usage(os.Stderr)
+	}
+	res := addJSONFlag(fs)
+	res.Command = "qcd"
+	hopts := addHashFlags(fs)
+	vfile := fs.String("v", "%s.qcd", "verification data `filename`, or - to write to standard output [%s replaced with input name]")
+	stdinName := fs.String("stdin-name", "", "logical source `name` for data read from standard input, used for -v and stored in the manifest")
+	extract := fs.String("extract-unverified", "", "write unverified records verbatim to `filename` when verifying")
+	progress := fs.Bool("progress", false, "show bytes read, records per second and ETA on standard error")
+	members := fs.Bool("m", false, "checksum each member of a zip or tar archive separately")
+	recursive := fs.Bool("R", false, "checksum every file in a directory into one manifest")
+	checkfile := fs.String("c", "", "verify every file listed in a `manifest`")
+	workers := fs.Int("j", 0, "number of files to checksum or verify in parallel (default: number of CPUs)")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+	if *vfile == qcd.Stdin && res.json {
+		return res.fail(exitUsage, "-v - cannot be used with --json")
+	}
+	if err := hopts.setup(); err != nil {
+		return res.fail(exitUsage, "%s", err.Error())
+	}
+
+	if *checkfile != "" {
+		return checkManifest(res, *checkfile, hopts.key, *workers)
+	}
+	if *recursive {
+		return sumDir(res, fs.Arg(0), *vfile, hopts.newChecksummer, *workers)
+	}
+
+	src, err := openInput(fs.Arg(0), *hopts.verbose)
+	if err != nil {
+		return res.fail(exitIO, "Error opening source file: %s", err.Error())
+	}
+	defer src.Close()
+
+	newChecksummer := hopts.newChecksummer
+	if *progress {
+		newChecksummer = newProgressMeter(src).wrap(newChecksummer)
+	}
+	srcName := sourceName(src, *stdinName)
+	name := manifestName(*vfile, srcName)
+	if name != "" && name != qcd.Stdin {
+		manifest, err := qcd.ReadManifest(name)
+		if err == nil {
+			fmt.Fprintln(os.Stderr, "Reading verification data from", name)
+			res.Input, res.Manifest = srcName, name
+			if *extract != "" {
+				x, err := newExtractor(*extract)
+				if err != nil {
+					return res.fail(exitIO, "Unable to extract unverified records: %s", err.Error())
+				}
+				res.atExit(x.Close)
+				newChecksummer = x.wrap(newChecksummer)
+			}
+			return verifyInput(res, src, manifest, newChecksummer)
+		}
+		if !os.IsNotExist(err) {
+			return res.fail(exitFor(err), "Unable to verify: -v '%s'\n    %s", name, err.Error())
+		}
+	}
+	return sumInput(res, src, srcName, name, *members, newChecksummer)
+}
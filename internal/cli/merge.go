@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/joiningdata/qcd"
+)
+
+// mergeMain implements "qcd merge base_file theirs_file ours_file", which
+// writes the merged records to standard output (or -o). Conflicts are
+// reported on standard error, and exit with status 1 (exitMismatch).
+func mergeMain(args []string) int {
+	fs := newFlagSet("merge", "base_file theirs_file ours_file")
+	res := addJSONFlag(fs)
+	outfile := fs.String("o", "", "write merged records to `filename` instead of standard output (required with --json)")
+	hopts := addSourceFlags(fs)
+	keycols := fs.String("key", "", "comma-separated key `columns` (names or numbers) to merge rows of delimited data")
+	delim := fs.String("d", ",", "field `delimiter` for -key (use \\t for tabs)")
+	header := fs.Bool("header", false, "first record is a header row (for -key)")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return res.exit(exitUsage)
+	}
+	if res.json && *outfile == "" {
+		return res.fail(exitUsage, "--json requires -o, as the result is printed to standard output")
+	}
+	if err := hopts.setup(); err != nil {
+		return res.fail(exitUsage, "%s", err.Error())
+	}
+	opts := hopts.sourceOptions()
+	res.Inputs = fs.Args()
+
+	var srcs [3]*qcd.Source
+	for i := range srcs {
+		var err error
+		srcs[i], err = qcd.NewSource(fs.Arg(i), opts...)
+		if err != nil {
+			return res.fail(exitFor(err), "Error loading %s: %s", fs.Arg(i), describeError(err))
+		}
+	}
+
+	var merged *qcd.MergeResult
+	var err error
+	if *keycols != "" {
+		kopts := qcd.KeyDiffOptions{
+			Columns: strings.Split(*keycols, ","),
+			Header:  *header,
+		}
+		if *delim == "\\t" {
+			kopts.Delimiter = '\t'
+		} else if *delim != "" {
+			kopts.Delimiter = []rune(*delim)[0]
+		}
+		merged, err = qcd.Merge3ByKey(srcs[0], srcs[1], srcs[2], kopts)
+	} else {
+		merged, err = qcd.Merge3(srcs[0], srcs[1], srcs[2])
+	}
+	if err != nil {
+		return res.fail(exitFor(err), "MERGE FAILED: %s", describeError(err))
+	}
+
+	var out io.Writer = os.Stdout
+	if *outfile != "" {
+		f, err := os.Create(*outfile)
+		if err != nil {
+			return res.fail(exitIO, "Error creating output file: %s", err.Error())
+		}
+		res.atExit(f.Close)
+		res.Output = *outfile
+		out = f
+	}
+	if _, err = merged.WriteTo(out); err != nil {
+		return res.fail(exitIO, "Error writing merged records: %s", err.Error())
+	}
+	res.Records = uint64(len(merged.Records))
+	res.Conflicts = len(merged.Conflicts)
+
+	for _, c := range merged.Conflicts {
+		fmt.Fprintf(os.Stderr, "CONFLICT (%s):\n", strings.Join(c.Key, ","))
+		fmt.Fprintf(os.Stderr, "    base:   %s\n", rowString(c.Base))
+		fmt.Fprintf(os.Stderr, "    theirs: %s\n", rowString(c.Theirs))
+		fmt.Fprintf(os.Stderr, "    ours:   %s\n", rowString(c.Ours))
+	}
+	if len(merged.Conflicts) > 0 {
+		fmt.Fprintf(os.Stderr, "MERGED WITH %d CONFLICTS (kept ours)\n", len(merged.Conflicts))
+		return res.exit(exitMismatch)
+	}
+	fmt.Fprintf(os.Stderr, "MERGE OK: %d records\n", len(merged.Records))
+	return res.exit(exitOK)
+}
+
+// rowString formats a conflicting row, which may have been deleted.
+func rowString(row *string) string {
+	if row == nil {
+		return "(deleted)"
+	}
+	return strings.TrimRight(*row, "\r\n")
+}
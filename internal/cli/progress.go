@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/joiningdata/qcd"
+)
+
+// progressMeter prints the progress of reading an input to standard
+// error, for --progress.
+type progressMeter struct {
+	src   *qcd.Input
+	start time.Time
+	last  time.Time
+
+	// totals of the Checksummers which have finished, e.g. for the
+	// earlier members of an archive
+	records uint64
+	bytes   uint64
+}
+
+func newProgressMeter(src *qcd.Input) *progressMeter {
+	return &progressMeter{src: src, start: time.Now()}
+}
+
+// wrap returns a newChecksummer function which reports the progress of
+// each Checksummer it creates to the meter.
+func (m *progressMeter) wrap(newChecksummer func() *qcd.Checksummer) func() *qcd.Checksummer {
+	return func() *qcd.Checksummer {
+		ck := newChecksummer()
+		ck.SetProgress(0, 1<<20, m.update)
+		return ck
+	}
+}
+
+// update prints the progress at most twice a second, and the totals
+// when a Checksummer reaches the end of its data.
+func (m *progressMeter) update(p qcd.Progress) {
+	if p.Done {
+		m.records += p.Records
+		m.bytes += p.Bytes
+		m.print(m.records, m.bytes)
+		fmt.Fprintln(os.Stderr)
+		return
+	}
+	if time.Since(m.last) < 500*time.Millisecond {
+		return
+	}
+	m.last = time.Now()
+	m.print(m.records+p.Records, m.bytes+p.Bytes)
+}
+
+func (m *progressMeter) print(records, nbytes uint64) {
+	elapsed := time.Since(m.start)
+	rate := float64(records) / elapsed.Seconds()
+	msg := fmt.Sprintf("%s read, %d records, %.0f records/s", formatBytes(nbytes), records, rate)
+
+	// the compressed size of a zip archive is known, but it is not read
+	// sequentially
+	size, done := m.src.Size, m.src.Consumed()
+	if size > 0 && done > 0 && m.src.Archive != "zip" {
+		frac := float64(done) / float64(size)
+		if frac > 1 {
+			frac = 1
+		}
+		eta := time.Duration(float64(elapsed) * (1 - frac) / frac)
+		msg += fmt.Sprintf(", %.1f%% of %s, ETA %s", 100*frac, formatBytes(uint64(size)),
+			eta.Round(time.Second))
+	}
+	fmt.Fprintf(os.Stderr, "\r%-78s", msg)
+}
+
+// formatBytes formats a byte count with a binary unit suffix.
+func formatBytes(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n) / 1024
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
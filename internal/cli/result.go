@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joiningdata/qcd"
+)
+
+// Exit statuses of the qcd subcommands, and of qcdiff.
+const (
+	// exitOK: checksummed, or verified with a matching content hash, or
+	// the files compared by diff have the same records
+	exitOK = 0
+	// exitMismatch: the content hash differs, but every record was
+	// found in the records_hash (e.g. records were removed or duplicated),
+	// or the files compared by diff differ, or a patch failed to apply,
+	// or a merge had conflicts
+	exitMismatch = 1
+	// exitUnverified: the content hash differs, and some records were
+	// not found in the records_hash (e.g. records were added or changed)
+	exitUnverified = 2
+	// exitUsage: invalid command line or options
+	exitUsage = 3
+	// exitIO: a data or manifest file could not be read or written
+	exitIO = 4
+	// exitBadManifest: a manifest is invalid, or can't be used with the data
+	exitBadManifest = 5
+)
+
+var statusNames = map[int]string{
+	exitOK:          "ok",
+	exitMismatch:    "mismatch",
+	exitUnverified:  "unverified",
+	exitUsage:       "usage_error",
+	exitIO:          "io_error",
+	exitBadManifest: "corrupt_manifest",
+}
+
+const exitStatusHelp = `Exit status:
+    0  OK: checksummed, or verified with a matching content hash (or
+       the files compared by diff have the same records)
+    1  content mismatch: records were removed or duplicated (or the
+       files compared by diff differ, a patch failed to apply, or a
+       merge had conflicts)
+    2  unverified records: records were added or changed
+    3  usage error
+    4  I/O error reading or writing a data or manifest file
+    5  corrupt manifest, or one which can't be used with the data
+`
+
+// exitFor returns the exit status for an error.
+func exitFor(err error) int {
+	var me *qcd.ManifestError
+	var mm *qcd.MaskMismatchError
+	if errors.As(err, &me) || errors.As(err, &mm) {
+		return exitBadManifest
+	}
+	var pm *qcd.PatchMismatchError
+	if errors.As(err, &pm) {
+		return exitMismatch
+	}
+	return exitIO
+}
+
+// worse returns the more severe of two exit statuses.
+func worse(a, b int) int {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// result is the outcome of a subcommand, printed to standard output as
+// a JSON object with --json.
+type result struct {
+	Command    string            `json:"command"`
+	Input      string            `json:"input,omitempty"`
+	Inputs     []string          `json:"inputs,omitempty"`
+	Manifest   string            `json:"manifest,omitempty"`
+	Patch      string            `json:"patch,omitempty"`
+	Output     string            `json:"output,omitempty"`
+	Status     string            `json:"status"`
+	ExitCode   int               `json:"exit_code"`
+	Error      string            `json:"error,omitempty"`
+	Records    uint64            `json:"records,omitempty"`
+	Unverified int               `json:"unverified_records,omitempty"`
+	Info       map[string]string `json:"info,omitempty"`
+	Files      []fileResult      `json:"files,omitempty"`
+	Diff       *qcd.DiffSummary  `json:"diff,omitempty"`
+	Conflicts  int               `json:"conflicts,omitempty"`
+
+	json bool
+	// called by exit before the result is printed
+	finish []func() error
+}
+
+// fileResult is the outcome for one file of a directory or archive.
+type fileResult struct {
+	Name       string            `json:"name"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	Records    uint64            `json:"records,omitempty"`
+	Unverified int               `json:"unverified_records,omitempty"`
+	Info       map[string]string `json:"info,omitempty"`
+}
+
+// atExit registers a function to be called before the result is
+// printed, such as closing an output file. If it fails, the command
+// fails with an I/O error.
+func (r *result) atExit(fn func() error) {
+	r.finish = append(r.finish, fn)
+}
+
+// exit records the exit status, prints the result if --json was given,
+// and returns the status.
+func (r *result) exit(status int) int {
+	finish := r.finish
+	r.finish = nil
+	for _, fn := range finish {
+		if err := fn(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			if r.Error == "" {
+				r.Error = err.Error()
+			}
+			status = worse(status, exitIO)
+		}
+	}
+	r.ExitCode = status
+	r.Status = statusNames[status]
+	if r.json {
+		json.NewEncoder(os.Stdout).Encode(r)
+	}
+	return status
+}
+
+// fail prints an error message to standard error and exits with status.
+func (r *result) fail(status int, format string, args ...interface{}) int {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintln(os.Stderr, msg)
+	r.Error = strings.Join(strings.Fields(msg), " ")
+	return r.exit(status)
+}
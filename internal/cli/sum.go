@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/joiningdata/qcd"
+)
+
+// sumMain implements "qcd sum", which checksums a data file (or standard
+// input), archive or directory and writes its manifest.
+func sumMain(args []string) int {
+	fs := newFlagSet("sum", "[data_file | -R directory]")
+	res := addJSONFlag(fs)
+	hopts := addHashFlags(fs)
+	vfile := fs.String("o", "%s.qcd", "manifest `filename` to write, or - for standard output [%s replaced with input name]")
+	stdinName := fs.String("stdin-name", "", "logical source `name` for data read from standard input, used for -o and stored in the manifest")
+	progress := fs.Bool("progress", false, "show bytes read, records per second and ETA on standard error")
+	members := fs.Bool("m", false, "checksum each member of a zip or tar archive separately")
+	recursive := fs.Bool("R", false, "checksum every file in a directory into one manifest")
+	workers := fs.Int("j", 0, "number of files to checksum in parallel with -R (default: number of CPUs)")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return res.exit(exitUsage)
+	}
+	if *vfile == qcd.Stdin && res.json {
+		return res.fail(exitUsage, "-o - cannot be used with --json")
+	}
+	if err := hopts.setup(); err != nil {
+		return res.fail(exitUsage, "%s", err.Error())
+	}
+	if *recursive {
+		return sumDir(res, fs.Arg(0), *vfile, hopts.newChecksummer, *workers)
+	}
+
+	src, err := openInput(fs.Arg(0), *hopts.verbose)
+	if err != nil {
+		return res.fail(exitIO, "Error opening source file: %s", err.Error())
+	}
+	defer src.Close()
+
+	newChecksummer := hopts.newChecksummer
+	if *progress {
+		newChecksummer = newProgressMeter(src).wrap(newChecksummer)
+	}
+	name := sourceName(src, *stdinName)
+	return sumInput(res, src, name, manifestName(*vfile, name), *members, newChecksummer)
+}
+
+// sumInput checksums an opened input with the given logical name, writes
+// its manifest to vfile ("-" for standard output, or not at all if empty)
+// and prints its checksum information.
+func sumInput(res *result, src *qcd.Input, name, vfile string, members bool, newChecksummer func() *qcd.Checksummer) int {
+	res.Input = name
+	res.Manifest = vfile
+
+	var manifest *qcd.Manifest
+	var err error
+	if members {
+		if src.Archive == "" {
+			return res.fail(exitUsage, "%s is not a zip or tar archive", src.Name)
+		}
+		files := make(map[string]map[string]string)
+		err = src.Members(func(name string, r io.Reader) error {
+			ck := newChecksummer()
+			if err := ck.Sum(r); err != nil {
+				return fmt.Errorf("%s: %s", name, err.Error())
+			}
+			files[name] = ck.Info()
+			res.Files = append(res.Files, fileResult{
+				Name:    name,
+				Status:  statusNames[exitOK],
+				Records: ck.Records(),
+				Info:    files[name],
+			})
+			return nil
+		})
+		if err == nil {
+			manifest, err = qcd.NewManifest(files)
+		}
+	} else {
+		ck := newChecksummer()
+		err = ck.Sum(src)
+		manifest = &qcd.Manifest{Dataset: ck.Info()}
+		res.Records = ck.Records()
+	}
+	if err != nil && err != io.EOF {
+		return res.fail(exitIO, "an error occured: %s", describeError(err))
+	}
+	if name != src.Name {
+		manifest.Dataset["source_name"] = name
+	}
+	res.Info = manifest.Dataset
+
+	if vfile != "" {
+		if err := writeManifest(manifest, vfile); err != nil {
+			return res.fail(exitIO, "error writing verification file: %s", err.Error())
+		}
+	}
+	printInfo(manifest.Dataset)
+	return res.exit(exitOK)
+}
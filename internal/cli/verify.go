@@ -0,0 +1,185 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/joiningdata/qcd"
+)
+
+// verifyMain implements "qcd verify", which verifies a data file (or
+// standard input) or archive against its manifest, or every file listed
+// in a directory manifest. Unlike the original interface, a missing
+// manifest is an error.
+func verifyMain(args []string) int {
+	fs := newFlagSet("verify", "[data_file | -c manifest]")
+	res := addJSONFlag(fs)
+	verbose := fs.Bool("e", false, "enable verbose errors (list unverified records)")
+	keyfile := fs.String("k", "", "secret key `filename` for keyed record hashing (or set $QCD_KEY)")
+	vfile := fs.String("v", "%s.qcd", "manifest `filename` [%s replaced with input name]")
+	stdinName := fs.String("stdin-name", "", "logical source `name` for data read from standard input, used for -v")
+	maxRec := addMaxRecordFlag(fs)
+	extract := fs.String("extract-unverified", "", "write unverified records verbatim to `filename`")
+	progress := fs.Bool("progress", false, "show bytes read, records per second and ETA on standard error")
+	checkfile := fs.String("c", "", "verify every file listed in a directory `manifest`")
+	workers := fs.Int("j", 0, "number of files to verify in parallel with -c (default: number of CPUs)")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+	if fs.NArg() > 1 || (*checkfile != "" && fs.NArg() > 0) {
+		fs.Usage()
+		return res.exit(exitUsage)
+	}
+	key, err := readKey(*keyfile)
+	if err != nil {
+		return res.fail(exitUsage, "Unable to read key: -k '%s'\n    %s", *keyfile, err.Error())
+	}
+	if *checkfile != "" {
+		return checkManifest(res, *checkfile, key, *workers)
+	}
+
+	srcName := fs.Arg(0)
+	if (srcName == "" || srcName == qcd.Stdin) && *stdinName != "" {
+		srcName = *stdinName
+	}
+	name := manifestName(*vfile, srcName)
+	if name == "" {
+		return res.fail(exitUsage, "Unable to verify: a manifest filename (-v) or --stdin-name is required for standard input")
+	}
+	res.Manifest = name
+	manifest, err := qcd.ReadManifest(name)
+	if err != nil {
+		return res.fail(exitFor(err), "Unable to verify: -v '%s'\n    %s", name, err.Error())
+	}
+	fmt.Fprintln(os.Stderr, "Reading verification data from", name)
+
+	src, err := openInput(fs.Arg(0), *verbose)
+	if err != nil {
+		return res.fail(exitIO, "Error opening source file: %s", err.Error())
+	}
+	defer src.Close()
+
+	newChecksummer := func() *qcd.Checksummer {
+		ck := &qcd.Checksummer{}
+		ck.SetKey(key)
+		ck.SetMaxRecordLength(*maxRec)
+		if *verbose {
+			ck.SetVerbose(os.Stderr)
+		}
+		return ck
+	}
+	if *progress {
+		newChecksummer = newProgressMeter(src).wrap(newChecksummer)
+	}
+	if *extract != "" {
+		x, err := newExtractor(*extract)
+		if err != nil {
+			return res.fail(exitIO, "Unable to extract unverified records: %s", err.Error())
+		}
+		res.atExit(x.Close)
+		newChecksummer = x.wrap(newChecksummer)
+	}
+	res.Input = srcName
+	return verifyInput(res, src, manifest, newChecksummer)
+}
+
+// verifyStatus returns the exit status for a verification result.
+func verifyStatus(ok bool, nb int) int {
+	switch {
+	case ok:
+		return exitOK
+	case nb == 0:
+		return exitMismatch
+	}
+	return exitUnverified
+}
+
+// verifyInput verifies an opened input against a manifest. Returns the
+// exit status.
+func verifyInput(res *result, src *qcd.Input, manifest *qcd.Manifest, newChecksummer func() *qcd.Checksummer) int {
+	if res.Input == "" {
+		res.Input = src.Name
+	}
+	if manifest.Files != nil {
+		if src.Archive == "" {
+			return res.fail(exitUsage, "%s is not a zip or tar archive", src.Name)
+		}
+		return verifyMembers(res, src, manifest, newChecksummer)
+	}
+
+	ck := newChecksummer()
+	ok, nb, err := ck.Verify(src, manifest.Dataset)
+	if err != nil {
+		return res.fail(exitFor(err), "unable to verify: %s", describeError(err))
+	}
+	reportVerify(ck, ok, nb)
+	res.Records = ck.Records()
+	res.Unverified = nb
+	return res.exit(verifyStatus(ok, nb))
+}
+
+// verifyMembers verifies each member of an archive against the per-member
+// checksum information in the manifest. Returns the exit status.
+func verifyMembers(res *result, src *qcd.Input, manifest *qcd.Manifest, newChecksummer func() *qcd.Checksummer) int {
+	status := exitOK
+	nbad := 0
+	seen := make(map[string]bool)
+	err := src.Members(func(name string, r io.Reader) error {
+		seen[name] = true
+		vdata, ok := manifest.Files[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: not in manifest\n", name)
+			res.Files = append(res.Files, fileResult{Name: name, Status: statusNames[exitUnverified],
+				Error: "not in manifest"})
+			status = worse(status, exitUnverified)
+			nbad++
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "Verifying %s\n", name)
+		ck := newChecksummer()
+		ok, nb, err := ck.Verify(r, vdata)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+		reportVerify(ck, ok, nb)
+		fstatus := verifyStatus(ok, nb)
+		res.Files = append(res.Files, fileResult{Name: name, Status: statusNames[fstatus],
+			Records: ck.Records(), Unverified: nb})
+		res.Records += ck.Records()
+		res.Unverified += nb
+		status = worse(status, fstatus)
+		if !ok {
+			nbad++
+		}
+		return nil
+	})
+	if err != nil {
+		return res.fail(exitFor(err), "unable to verify: %s", describeError(err))
+	}
+	for name := range manifest.Files {
+		if !seen[name] {
+			fmt.Fprintf(os.Stderr, "%s: missing from archive\n", name)
+			res.Files = append(res.Files, fileResult{Name: name, Status: statusNames[exitMismatch],
+				Error: "missing from archive"})
+			status = worse(status, exitMismatch)
+			nbad++
+		}
+	}
+	if nbad > 0 {
+		fmt.Fprintf(os.Stderr, "ARCHIVE FAILED: %d of %d members\n", nbad, len(res.Files))
+	} else {
+		fmt.Fprintln(os.Stderr, "ARCHIVE OK")
+	}
+	return res.exit(status)
+}
+
+// reportVerify prints the result of verifying a data source.
+func reportVerify(ck *qcd.Checksummer, ok bool, nb int) {
+	if ok {
+		fmt.Fprintln(os.Stderr, "CHECKSUM OK")
+		return
+	}
+	fmt.Fprintln(os.Stderr, "CHECKSUM FAILED")
+	fmt.Fprintf(os.Stderr, "%d/%d records failed verification\n", nb, ck.Records())
+}
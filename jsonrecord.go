@@ -0,0 +1,438 @@
+package qcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// JSONOptions configures the JSON record format, see SetJSON.
+type JSONOptions struct {
+	// Include lists JSON pointers (RFC 6901) to the values which are
+	// checksummed, the whole record if empty. Their enclosing objects
+	// and arrays are kept, and array elements keep their order.
+	Include []string `json:"include,omitempty"`
+
+	// Exclude lists JSON pointers to values which are removed before the
+	// record is checksummed, after Include is applied.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// jsonFormat canonicalizes JSON records.
+type jsonFormat struct {
+	opts    JSONOptions
+	include *pointerTree
+	exclude *pointerTree
+}
+
+func newJSONFormat(opts *JSONOptions) (*jsonFormat, error) {
+	f := &jsonFormat{opts: *opts}
+	var err error
+	if len(opts.Include) > 0 {
+		if f.include, err = newPointerTree(opts.Include); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Exclude) > 0 {
+		if f.exclude, err = newPointerTree(opts.Exclude); err != nil {
+			return nil, err
+		}
+		if f.exclude.all {
+			return nil, fmt.Errorf("the whole record cannot be excluded")
+		}
+	}
+	return f, nil
+}
+
+// canonical returns the canonical serialization of a JSON record, as
+// defined by the JSON Canonicalization Scheme (RFC 8785), after the
+// include and exclude pointers are applied.
+func (f *jsonFormat) canonical(record []byte) ([]byte, error) {
+	v, err := parseJSON(record)
+	if err != nil {
+		return nil, err
+	}
+	if f.include != nil {
+		var ok bool
+		if v, ok = f.include.project(v); !ok {
+			v = map[string]interface{}{}
+		}
+	}
+	if f.exclude != nil {
+		v = f.exclude.remove(v)
+	}
+	buf := &bytes.Buffer{}
+	if err = writeCanonicalJSON(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// info adds the JSON options to a Checksummer's Info().
+func (f *jsonFormat) info(r map[string]string) {
+	r["record_format"] = "json"
+	if len(f.opts.Include) > 0 {
+		b, _ := json.Marshal(f.opts.Include)
+		r["json_include"] = string(b)
+	}
+	if len(f.opts.Exclude) > 0 {
+		b, _ := json.Marshal(f.opts.Exclude)
+		r["json_exclude"] = string(b)
+	}
+}
+
+// jsonOptionsFromInfo returns the JSON options stored in verification
+// data, or nil if it does not use the JSON record format.
+func jsonOptionsFromInfo(verify map[string]string) (*JSONOptions, error) {
+	switch verify["record_format"] {
+	case "", "fixed":
+		return nil, nil
+	case "json":
+	default:
+		return nil, fmt.Errorf("unknown record_format '%s'", verify["record_format"])
+	}
+	opts := &JSONOptions{}
+	if x := verify["json_include"]; x != "" {
+		if err := json.Unmarshal([]byte(x), &opts.Include); err != nil {
+			return nil, fmt.Errorf("invalid json_include: %s", err.Error())
+		}
+	}
+	if x := verify["json_exclude"]; x != "" {
+		if err := json.Unmarshal([]byte(x), &opts.Exclude); err != nil {
+			return nil, fmt.Errorf("invalid json_exclude: %s", err.Error())
+		}
+	}
+	return opts, nil
+}
+
+// checkRecordFormats returns an error if two sources' verification data
+// show that their records were split or parsed differently.
+func checkRecordFormats(left, right map[string]string) error {
+	for _, k := range []string{"line_mode", "record_format", "json_include", "json_exclude", "record_layout"} {
+		if left[k] != right[k] {
+			return fmt.Errorf("sources were parsed into records differently (%s '%s' vs '%s')",
+				k, left[k], right[k])
+		}
+	}
+	return nil
+}
+
+//////////////////
+
+// parseJSON parses a single JSON value, keeping numbers as json.Number
+// and rejecting objects with duplicate member names.
+func parseJSON(record []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(record))
+	d.UseNumber()
+	v, err := parseJSONValue(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err.Error())
+	}
+	if _, err = d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON: data after the top-level value")
+	}
+	return v, nil
+}
+
+func parseJSONValue(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		obj := make(map[string]interface{})
+		for d.More() {
+			kt, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			k := kt.(string)
+			if _, dup := obj[k]; dup {
+				return nil, fmt.Errorf("duplicate member name %q", k)
+			}
+			if obj[k], err = parseJSONValue(d); err != nil {
+				return nil, err
+			}
+		}
+		_, err = d.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []interface{}{}
+		for d.More() {
+			v, err := parseJSONValue(d)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err = d.Token()
+		return arr, err
+	}
+	return t, nil
+}
+
+// writeCanonicalJSON serializes a parsed JSON value as described in
+// RFC 8785: no whitespace, object members sorted by the UTF-16 code
+// units of their names, minimal string escapes, and numbers formatted as
+// in ECMAScript.
+func writeCanonicalJSON(w *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		w.WriteString("null")
+	case bool:
+		w.WriteString(strconv.FormatBool(x))
+	case string:
+		writeCanonicalString(w, x)
+	case json.Number:
+		s, err := canonicalNumber(x)
+		if err != nil {
+			return err
+		}
+		w.WriteString(s)
+	case []interface{}:
+		w.WriteByte('[')
+		for i, e := range x {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(w, e); err != nil {
+				return err
+			}
+		}
+		w.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return lessUTF16(keys[i], keys[j])
+		})
+		w.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeCanonicalString(w, k)
+			w.WriteByte(':')
+			if err := writeCanonicalJSON(w, x[k]); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('}')
+	default:
+		return fmt.Errorf("unexpected JSON value %T", v)
+	}
+	return nil
+}
+
+// lessUTF16 compares strings by their UTF-16 code units.
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+func writeCanonicalString(w *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	w.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			w.WriteRune(r)
+			i += size
+			continue
+		}
+		switch c {
+		case '"', '\\':
+			w.WriteByte('\\')
+			w.WriteByte(c)
+		case '\b':
+			w.WriteString(`\b`)
+		case '\f':
+			w.WriteString(`\f`)
+		case '\n':
+			w.WriteString(`\n`)
+		case '\r':
+			w.WriteString(`\r`)
+		case '\t':
+			w.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				w.WriteString(`\u00`)
+				w.WriteByte(hex[c>>4])
+				w.WriteByte(hex[c&0xf])
+			} else {
+				w.WriteByte(c)
+			}
+		}
+		i++
+	}
+	w.WriteByte('"')
+}
+
+// canonicalNumber formats a JSON number as an IEEE 754 double in the
+// manner of ECMAScript's Number.prototype.toString.
+func canonicalNumber(n json.Number) (string, error) {
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil || math.IsInf(f, 0) {
+		return "", fmt.Errorf("number %s cannot be represented as a double", n)
+	}
+	if f == 0 {
+		return "0", nil
+	}
+	sign := ""
+	if f < 0 {
+		sign, f = "-", -f
+	}
+
+	// shortest digits which round-trip, and the decimal exponent
+	es := strconv.FormatFloat(f, 'e', -1, 64)
+	mant, exp := es[:strings.IndexByte(es, 'e')], es[strings.IndexByte(es, 'e')+1:]
+	digits := strings.Replace(mant, ".", "", 1)
+	e, _ := strconv.Atoi(exp)
+	k, p := len(digits), e+1 // p: position of the decimal point
+
+	switch {
+	case k <= p && p <= 21:
+		return sign + digits + strings.Repeat("0", p-k), nil
+	case 0 < p && p <= 21:
+		return sign + digits[:p] + "." + digits[p:], nil
+	case -6 < p && p <= 0:
+		return sign + "0." + strings.Repeat("0", -p) + digits, nil
+	}
+	s := digits[:1]
+	if k > 1 {
+		s += "." + digits[1:]
+	}
+	if p-1 >= 0 {
+		return sign + s + "e+" + strconv.Itoa(p-1), nil
+	}
+	return sign + s + "e-" + strconv.Itoa(1-p), nil
+}
+
+//////////////////
+
+// pointerTree is a set of JSON pointers, as a tree of reference tokens.
+type pointerTree struct {
+	// all is true if a pointer ends at this node
+	all      bool
+	children map[string]*pointerTree
+}
+
+func newPointerTree(pointers []string) (*pointerTree, error) {
+	root := &pointerTree{}
+	for _, p := range pointers {
+		tokens, err := parsePointer(p)
+		if err != nil {
+			return nil, err
+		}
+		node := root
+		for _, t := range tokens {
+			if node.children == nil {
+				node.children = make(map[string]*pointerTree)
+			}
+			child, ok := node.children[t]
+			if !ok {
+				child = &pointerTree{}
+				node.children[t] = child
+			}
+			node = child
+		}
+		node.all = true
+	}
+	return root, nil
+}
+
+// parsePointer splits a JSON pointer into its unescaped reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer '%s': must start with '/'", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// project returns the parts of v selected by the tree, or false if
+// nothing was selected.
+func (t *pointerTree) project(v interface{}) (interface{}, bool) {
+	if t.all {
+		return v, true
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		r := make(map[string]interface{})
+		for k, child := range t.children {
+			if cv, ok := x[k]; ok {
+				if pv, ok := child.project(cv); ok {
+					r[k] = pv
+				}
+			}
+		}
+		return r, len(r) > 0
+	case []interface{}:
+		r := []interface{}{}
+		for i, e := range x {
+			if child, ok := t.children[strconv.Itoa(i)]; ok {
+				if pv, ok := child.project(e); ok {
+					r = append(r, pv)
+				}
+			}
+		}
+		return r, len(r) > 0
+	}
+	return nil, false
+}
+
+// remove returns v without the parts selected by the tree.
+func (t *pointerTree) remove(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t.children {
+			cv, ok := x[k]
+			if !ok {
+				continue
+			}
+			if child.all {
+				delete(x, k)
+			} else {
+				x[k] = child.remove(cv)
+			}
+		}
+	case []interface{}:
+		r := x[:0]
+		for i, e := range x {
+			child, ok := t.children[strconv.Itoa(i)]
+			switch {
+			case !ok:
+				r = append(r, e)
+			case !child.all:
+				r = append(r, child.remove(e))
+			}
+		}
+		return r
+	}
+	return v
+}
@@ -0,0 +1,352 @@
+package qcd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// KeyDiffOptions describes how to match rows of delimited data by key.
+type KeyDiffOptions struct {
+	// Columns are the key columns, either 1-based column numbers or
+	// column names from the header row.
+	Columns []string
+
+	// Delimiter separates fields, ',' if zero.
+	Delimiter rune
+
+	// Header indicates that the first record of each source is a header row.
+	Header bool
+}
+
+// RowChange describes a row whose key is in both sources but whose
+// other fields differ.
+type RowChange struct {
+	Key []string `json:"key"`
+	Old []string `json:"old"`
+	New []string `json:"new"`
+
+	// Columns are the (0-based) indexes of the fields that differ.
+	Columns []int `json:"changed_columns"`
+}
+
+// DuplicateKey is a key which appears in more than one row of a source.
+type DuplicateKey struct {
+	Source string   `json:"source"`
+	Key    []string `json:"key"`
+	Rows   int      `json:"rows"`
+}
+
+// KeyDiffResult contains the rows added, removed and changed between
+// two sources when matched by key.
+type KeyDiffResult struct {
+	Header     []string       `json:"header,omitempty"`
+	KeyColumns []int          `json:"key_columns"`
+	Added      [][]string     `json:"added"`
+	Removed    [][]string     `json:"removed"`
+	Changed    []RowChange    `json:"changed"`
+	Duplicates []DuplicateKey `json:"duplicate_keys,omitempty"`
+
+	delim string
+}
+
+// Same returns true if no rows were added, removed or changed.
+func (r *KeyDiffResult) Same() bool {
+	return len(r.Added) == 0 && len(r.Removed) == 0 && len(r.Changed) == 0
+}
+
+type keyedRows struct {
+	header []string
+	keys   []int
+	order  []string
+	rows   map[string][][]string
+
+	// record numbers (0-based, including any header) of each row
+	index map[string][]int
+}
+
+// DiffByKey compares the other source to this one as delimited data,
+// matching rows by the values in the key columns rather than by
+// their position or full content. Fields are compared by position.
+// Returns a MaskMismatchError if the sources were masked differently.
+func (s *Source) DiffByKey(other *Source, opts KeyDiffOptions) (*KeyDiffResult, error) {
+	if err := s.checkMasks(other); err != nil {
+		return nil, err
+	}
+	left, err := parseKeyedRows(s, opts)
+	if err != nil {
+		return nil, err
+	}
+	right, err := parseKeyedRows(other, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &KeyDiffResult{
+		Header:     left.header,
+		KeyColumns: left.keys,
+		Added:      [][]string{},
+		Removed:    [][]string{},
+		Changed:    []RowChange{},
+		delim:      ",",
+	}
+	if opts.Delimiter != 0 {
+		res.delim = string(opts.Delimiter)
+	}
+	res.Duplicates = append(left.duplicates(s.Filename), right.duplicates(other.Filename)...)
+
+	for _, k := range left.order {
+		lrows, rrows := left.rows[k], right.rows[k]
+
+		// rows which are identical on both sides are not changed,
+		// even when the key is duplicated.
+		lrows, rrows = removeCommonRows(lrows, rrows)
+		if len(lrows) == 1 && len(rrows) == 1 {
+			res.Changed = append(res.Changed, RowChange{
+				Key:     left.key(lrows[0]),
+				Old:     lrows[0],
+				New:     rrows[0],
+				Columns: changedColumns(lrows[0], rrows[0]),
+			})
+			continue
+		}
+		res.Removed = append(res.Removed, lrows...)
+		res.Added = append(res.Added, rrows...)
+	}
+	for _, k := range right.order {
+		if _, ok := left.rows[k]; !ok {
+			res.Added = append(res.Added, right.rows[k]...)
+		}
+	}
+	return res, nil
+}
+
+// parseKeyedRows splits the source's records into fields and groups them by key.
+func parseKeyedRows(s *Source, opts KeyDiffOptions) (*keyedRows, error) {
+	if len(opts.Columns) == 0 {
+		return nil, fmt.Errorf("no key columns given")
+	}
+	lines := s.lines
+	first := 0
+	kr := &keyedRows{
+		rows:  make(map[string][][]string),
+		index: make(map[string][]int),
+	}
+	if opts.Header && len(lines) > 0 {
+		hdr, err := splitRecord(lines[0], opts.Delimiter)
+		if err != nil {
+			return nil, fmt.Errorf("%s: header: %s", s.Filename, err.Error())
+		}
+		kr.header = hdr
+		lines = lines[1:]
+		first = 1
+	}
+
+	for _, col := range opts.Columns {
+		idx, err := kr.columnIndex(col)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", s.Filename, err.Error())
+		}
+		kr.keys = append(kr.keys, idx)
+	}
+
+	for i, line := range lines {
+		fields, err := splitRecord(line, opts.Delimiter)
+		if err != nil {
+			return nil, fmt.Errorf("%s: record %d: %s", s.Filename, i+1, err.Error())
+		}
+		k := strings.Join(kr.key(fields), "\x00")
+		if _, ok := kr.rows[k]; !ok {
+			kr.order = append(kr.order, k)
+		}
+		kr.rows[k] = append(kr.rows[k], fields)
+		kr.index[k] = append(kr.index[k], first+i)
+	}
+	return kr, nil
+}
+
+// columnIndex resolves a key column name or 1-based number to a field index.
+func (kr *keyedRows) columnIndex(col string) (int, error) {
+	for i, h := range kr.header {
+		if h == col {
+			return i, nil
+		}
+	}
+	n, err := strconv.Atoi(col)
+	if err != nil || n < 1 {
+		return -1, fmt.Errorf("unknown key column '%s'", col)
+	}
+	return n - 1, nil
+}
+
+// key returns the key fields of a row, missing fields are empty.
+func (kr *keyedRows) key(fields []string) []string {
+	k := make([]string, len(kr.keys))
+	for i, idx := range kr.keys {
+		if idx < len(fields) {
+			k[i] = fields[idx]
+		}
+	}
+	return k
+}
+
+func (kr *keyedRows) duplicates(name string) []DuplicateKey {
+	var dups []DuplicateKey
+	for _, k := range kr.order {
+		if n := len(kr.rows[k]); n > 1 {
+			dups = append(dups, DuplicateKey{
+				Source: name,
+				Key:    kr.key(kr.rows[k][0]),
+				Rows:   n,
+			})
+		}
+	}
+	return dups
+}
+
+// splitRecord splits a single delimited record into fields.
+func splitRecord(record string, delim rune) ([]string, error) {
+	cr := csv.NewReader(strings.NewReader(record))
+	if delim != 0 {
+		cr.Comma = delim
+	}
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	fields, err := cr.Read()
+	if err == io.EOF {
+		// blank record
+		return []string{""}, nil
+	}
+	return fields, err
+}
+
+// removeCommonRows removes rows which are identical on both sides.
+func removeCommonRows(left, right [][]string) ([][]string, [][]string) {
+	var lrest [][]string
+	used := make([]bool, len(right))
+nextLeft:
+	for _, l := range left {
+		for j, r := range right {
+			if !used[j] && len(changedColumns(l, r)) == 0 {
+				used[j] = true
+				continue nextLeft
+			}
+		}
+		lrest = append(lrest, l)
+	}
+	var rrest [][]string
+	for j, r := range right {
+		if !used[j] {
+			rrest = append(rrest, r)
+		}
+	}
+	return lrest, rrest
+}
+
+// changedColumns returns the indexes of fields which differ.
+func changedColumns(old, new []string) []int {
+	var cols []int
+	n := len(old)
+	if len(new) > n {
+		n = len(new)
+	}
+	for i := 0; i < n; i++ {
+		var o, v string
+		if i < len(old) {
+			o = old[i]
+		}
+		if i < len(new) {
+			v = new[i]
+		}
+		if o != v {
+			cols = append(cols, i)
+		}
+	}
+	return cols
+}
+
+// columnName returns the header name of a column, or its 1-based number.
+func (r *KeyDiffResult) columnName(idx int) string {
+	if idx < len(r.Header) {
+		return r.Header[idx]
+	}
+	return fmt.Sprintf("column %d", idx+1)
+}
+
+func fieldAt(fields []string, idx int) string {
+	if idx < len(fields) {
+		return fields[idx]
+	}
+	return ""
+}
+
+// WriteWarnings writes a warning for each duplicate key, which are not
+// part of the text diff (see WriteText), e.g. to standard error.
+func (r *KeyDiffResult) WriteWarnings(w io.Writer) error {
+	for _, d := range r.Duplicates {
+		_, err := fmt.Fprintf(w, "WARNING: duplicate key (%s) in %d rows of %s\n",
+			strings.Join(d.Key, r.delim), d.Rows, d.Source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteText writes the key diff in a human-readable form. Removed rows
+// are prefixed with "-", added rows with "+", and changed rows with "~"
+// followed by each changed column's old and new values. Duplicate keys
+// are not included, see WriteWarnings.
+func (r *KeyDiffResult) WriteText(w io.Writer) error {
+	for _, row := range r.Removed {
+		fmt.Fprintln(w, "-"+strings.Join(row, r.delim))
+	}
+	for _, row := range r.Added {
+		fmt.Fprintln(w, "+"+strings.Join(row, r.delim))
+	}
+	for _, c := range r.Changed {
+		fmt.Fprintf(w, "~(%s)", strings.Join(c.Key, r.delim))
+		for _, idx := range c.Columns {
+			fmt.Fprintf(w, " %s: %q -> %q;", r.columnName(idx), fieldAt(c.Old, idx), fieldAt(c.New, idx))
+		}
+		_, err := fmt.Fprintln(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the key diff as a single JSON object.
+func (r *KeyDiffResult) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// WriteCSV writes the key diff as CSV. The first column contains the type
+// of change (added, removed, changed) and the second the names of the
+// changed columns, followed by the fields of the row. Changed rows are
+// written with their new values.
+func (r *KeyDiffResult) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if r.Header != nil {
+		cw.Write(append([]string{"change", "changed_columns"}, r.Header...))
+	}
+	for _, row := range r.Removed {
+		cw.Write(append([]string{"removed", ""}, row...))
+	}
+	for _, row := range r.Added {
+		cw.Write(append([]string{"added", ""}, row...))
+	}
+	for _, c := range r.Changed {
+		names := make([]string, len(c.Columns))
+		for i, idx := range c.Columns {
+			names[i] = r.columnName(idx)
+		}
+		cw.Write(append([]string{"changed", strings.Join(names, ";")}, c.New...))
+	}
+	cw.Flush()
+	return cw.Error()
+}
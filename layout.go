@@ -0,0 +1,219 @@
+package qcd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LayoutField is a named column of a fixed-width record.
+type LayoutField struct {
+	Name string `json:"name"`
+	// Offset is the position of the field's first byte, starting at 0.
+	Offset int `json:"offset"`
+	// Length is the width of the field in bytes.
+	Length int `json:"length"`
+}
+
+// Layout describes fixed-width records, see SetLayout.
+type Layout struct {
+	// RecordLength, if non-zero, is the length of every record in bytes.
+	// Records are then read back to back, without line terminators,
+	// instead of one per line.
+	RecordLength int `json:"record_length,omitempty"`
+
+	// Fields are the columns of each record. Bytes which are not in any
+	// field (filler) are ignored.
+	Fields []LayoutField `json:"fields"`
+
+	// Include lists the names of the fields which are checksummed, all
+	// of them if empty.
+	Include []string `json:"include,omitempty"`
+
+	// Mask lists the names of fields whose contents are ignored, e.g.
+	// timestamps or sequence numbers.
+	Mask []string `json:"mask,omitempty"`
+}
+
+// ReadLayout reads a layout specification from a file. Each line of the
+// file gives a field's name, offset and length, separated by whitespace.
+// If the offset is left out, the field immediately follows the previous
+// one, in the manner of a COBOL copybook. A "record_length" line sets
+// the RecordLength, and blank lines and lines starting with # are
+// ignored. For example:
+//
+//	record_length 80
+//	account    0  10
+//	name          30
+//	balance       12
+func ReadLayout(filename string) (*Layout, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l, err := parseLayout(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return l, nil
+}
+
+func parseLayout(r io.Reader) (*Layout, error) {
+	l := &Layout{}
+	next := 0
+	sc := bufio.NewScanner(r)
+	for lineno := 1; sc.Scan(); lineno++ {
+		parts := strings.Fields(sc.Text())
+		if len(parts) == 0 || strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		nums := make([]int, len(parts)-1)
+		for i, p := range parts[1:] {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid number '%s'", lineno, p)
+			}
+			nums[i] = n
+		}
+
+		if parts[0] == "record_length" {
+			if len(nums) != 1 {
+				return nil, fmt.Errorf("line %d: expected 'record_length length'", lineno)
+			}
+			l.RecordLength = nums[0]
+			continue
+		}
+		fld := LayoutField{Name: parts[0], Offset: next}
+		switch len(nums) {
+		case 1:
+			fld.Length = nums[0]
+		case 2:
+			fld.Offset, fld.Length = nums[0], nums[1]
+		default:
+			return nil, fmt.Errorf("line %d: expected 'name [offset] length'", lineno)
+		}
+		l.Fields = append(l.Fields, fld)
+		next = fld.Offset + fld.Length
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// width returns the number of bytes of a record covered by the fields.
+func (l *Layout) width() int {
+	w := 0
+	for _, f := range l.Fields {
+		if end := f.Offset + f.Length; end > w {
+			w = end
+		}
+	}
+	return w
+}
+
+//////////////////
+
+// layoutFormat applies a Layout to records.
+type layoutFormat struct {
+	layout Layout
+	width  int
+	// fields to checksum, excluding masked fields
+	keep []LayoutField
+}
+
+func newLayoutFormat(l *Layout) (*layoutFormat, error) {
+	if len(l.Fields) == 0 {
+		return nil, fmt.Errorf("layout has no fields")
+	}
+	byName := make(map[string]LayoutField)
+	for _, f := range l.Fields {
+		if f.Name == "" || strings.ContainsAny(f.Name, " \t#") {
+			return nil, fmt.Errorf("invalid field name '%s'", f.Name)
+		}
+		if _, dup := byName[f.Name]; dup {
+			return nil, fmt.Errorf("duplicate field '%s'", f.Name)
+		}
+		if f.Offset < 0 || f.Length <= 0 {
+			return nil, fmt.Errorf("field '%s' has invalid offset %d or length %d", f.Name, f.Offset, f.Length)
+		}
+		byName[f.Name] = f
+	}
+	lf := &layoutFormat{layout: *l, width: l.width()}
+	if l.RecordLength < 0 || (l.RecordLength > 0 && l.RecordLength < lf.width) {
+		return nil, fmt.Errorf("record length %d does not fit the fields (%d bytes)", l.RecordLength, lf.width)
+	}
+
+	masked := make(map[string]bool)
+	for _, name := range l.Mask {
+		if _, ok := byName[name]; !ok {
+			return nil, fmt.Errorf("unknown field '%s' in mask", name)
+		}
+		masked[name] = true
+	}
+	keep := l.Fields
+	if len(l.Include) > 0 {
+		keep = nil
+		for _, name := range l.Include {
+			f, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown field '%s' in include", name)
+			}
+			keep = append(keep, f)
+		}
+	}
+	for _, f := range keep {
+		if !masked[f.Name] {
+			lf.keep = append(lf.keep, f)
+		}
+	}
+	if len(lf.keep) == 0 {
+		return nil, fmt.Errorf("every field is masked")
+	}
+	return lf, nil
+}
+
+// project returns the record with every byte which is not in a field to
+// be checksummed replaced by a space, so that masked columns keep their
+// positions. The result is as wide as the fields; shorter records (e.g.
+// lines with trailing spaces removed) are padded with spaces, and bytes
+// after the last field are ignored.
+func (lf *layoutFormat) project(record []byte) []byte {
+	r := bytes.Repeat([]byte{' '}, lf.width)
+	for _, f := range lf.keep {
+		if f.Offset < len(record) {
+			end := f.Offset + f.Length
+			if end > len(record) {
+				end = len(record)
+			}
+			copy(r[f.Offset:], record[f.Offset:end])
+		}
+	}
+	return r
+}
+
+// info adds the layout to a Checksummer's Info().
+func (lf *layoutFormat) info(r map[string]string) {
+	r["record_format"] = "fixed"
+	b, _ := json.Marshal(lf.layout)
+	r["record_layout"] = string(b)
+}
+
+// layoutFromInfo returns the layout stored in verification data, or nil
+// if it does not use the fixed-width record format.
+func layoutFromInfo(verify map[string]string) (*Layout, error) {
+	if verify["record_format"] != "fixed" {
+		return nil, nil
+	}
+	l := &Layout{}
+	if err := json.Unmarshal([]byte(verify["record_layout"]), l); err != nil {
+		return nil, fmt.Errorf("invalid record_layout: %s", err.Error())
+	}
+	return l, nil
+}
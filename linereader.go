@@ -0,0 +1,520 @@
+package qcd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+)
+
+// DefaultMaxRecordLength is the longest record (in bytes, excluding the
+// line terminator) that is read unless SetMaxRecordLength is used.
+const DefaultMaxRecordLength = maxLineLength
+
+// UnlimitedRecordLength can be passed to SetMaxRecordLength to read
+// records of any length.
+const UnlimitedRecordLength = -1
+
+// formatRecordLimit returns the max_record_length stored for a limit set
+// by SetMaxRecordLength, in which 0 means there is no limit.
+func formatRecordLimit(n int) string {
+	if n < 0 {
+		return "0"
+	}
+	return fmt.Sprint(n)
+}
+
+// parseRecordLimit parses a stored max_record_length, returning 0 (the
+// default limit) if it is empty.
+func parseRecordLimit(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid max_record_length '%s'", s)
+	}
+	if n == 0 {
+		return UnlimitedRecordLength, nil
+	}
+	return n, nil
+}
+
+// widerRecordLimit returns the more permissive of two limits set by
+// SetMaxRecordLength.
+func widerRecordLimit(a, b int) int {
+	switch {
+	case a < 0 || b < 0:
+		return UnlimitedRecordLength
+	case a == 0 && b == 0:
+		return 0
+	case a == 0:
+		a = DefaultMaxRecordLength
+	case b == 0:
+		b = DefaultMaxRecordLength
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// RecordTooLongError is returned when a record is longer than the
+// maximum record length.
+type RecordTooLongError struct {
+	// Line is the line number of the record.
+	Line uint64
+	// Limit is the maximum record length in bytes.
+	Limit int
+}
+
+func (e *RecordTooLongError) Error() string {
+	return fmt.Sprintf("line %d: record is longer than %d bytes", e.Line, e.Limit)
+}
+
+// LineMode selects how data is split into records.
+type LineMode string
+
+const (
+	// DefaultLines splits records like bufio.ScanLines: a carriage
+	// return before a newline is removed, and a missing final newline is
+	// ignored. A UTF-8 byte order mark is part of the first record.
+	DefaultLines LineMode = ""
+
+	// ExactLines hashes each record with its line terminator, so that
+	// data only verifies if it is byte-for-byte identical (apart from the
+	// order of the records).
+	ExactLines LineMode = "exact"
+
+	// CanonicalLines ignores the differences between text files which
+	// are usually insignificant: a UTF-8 byte order mark, CRLF line
+	// endings, a missing final newline and trailing blank lines.
+	CanonicalLines LineMode = "canonical"
+)
+
+// LineModes lists the available line modes.
+var LineModes = []LineMode{DefaultLines, ExactLines, CanonicalLines}
+
+func (m LineMode) valid() bool {
+	for _, x := range LineModes {
+		if m == x {
+			return true
+		}
+	}
+	return false
+}
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// InputProperties describes the line structure detected in a data
+// stream, whatever the LineMode.
+type InputProperties struct {
+	// BOM is true if the data started with a UTF-8 byte order mark.
+	BOM bool
+	// LF and CRLF are the number of lines terminated by a newline, and
+	// by a carriage return and newline.
+	LF, CRLF uint64
+	// FinalNewline is false if the last line was not terminated.
+	FinalNewline bool
+	// TrailingBlankLines is the number of empty lines at the end of the
+	// data.
+	TrailingBlankLines uint64
+}
+
+// LineEndings returns "lf", "crlf", "mixed", or "none" if no line was
+// terminated.
+func (p *InputProperties) LineEndings() string {
+	switch {
+	case p.LF > 0 && p.CRLF > 0:
+		return "mixed"
+	case p.CRLF > 0:
+		return "crlf"
+	case p.LF > 0:
+		return "lf"
+	}
+	return "none"
+}
+
+// recordScanner is implemented by bufio.Scanner and lineReader.
+type recordScanner interface {
+	Scan() bool
+	Bytes() []byte
+	Err() error
+}
+
+// lineRecord is a record read by a lineReader.
+type lineRecord struct {
+	line uint64
+	rec  []byte
+	// digest of a streamed record, or nil
+	digest hash.Hash
+	// bytes read for the record, including its terminator
+	n int
+	// length of the record, excluding its terminator
+	size int
+	// a carriage return which has not been added to the record yet,
+	// as it may be part of the line terminator
+	cr bool
+	// the line has only been partly read, see writeBuffer
+	partial bool
+	// the record was followed by a line terminator which is not
+	// included in rec
+	term bool
+}
+
+func (r *lineRecord) reset() {
+	*r = lineRecord{rec: r.rec[:0]}
+}
+
+// lineReader reads newline-terminated records according to a LineMode,
+// and reports records which are too long with their line number.
+// Without a limit, records longer than maxLineLength are passed through
+// a hash.Hash as they are read instead of being held in memory.
+type lineReader struct {
+	r    *bufio.Reader
+	max  int
+	mode LineMode
+	// if non-zero, records are this many bytes long and are not
+	// terminated by newlines, see Layout
+	recLen int
+	// the Input being read, if any, which needs to know whether
+	// records are fixed-length to read the members of an archive
+	in *Input
+
+	// newHash returns the hash for streaming a long record, or nil if
+	// records must be held in memory (e.g. to apply a mask).
+	newHash func() hash.Hash
+
+	lines uint64
+	cur   lineRecord
+	// bytes read for the lines which have been read completely
+	complete int64
+
+	// in CanonicalLines mode, blank lines are only returned once the
+	// following record has been read (into held)
+	blanks []int
+	held   *lineRecord
+
+	props InputProperties
+	err   error
+}
+
+func newLineReader(r io.Reader, max int, mode LineMode, newHash func() hash.Hash) *lineReader {
+	if max == 0 {
+		max = DefaultMaxRecordLength
+	}
+	in, _ := r.(*Input)
+	return &lineReader{
+		r:       bufio.NewReaderSize(r, 64<<10),
+		in:      in,
+		max:     max,
+		mode:    mode,
+		newHash: newHash,
+		props:   InputProperties{FinalNewline: true},
+	}
+}
+
+// Scan advances to the next record, returning false at the end of the
+// data or if an error occurred.
+func (lr *lineReader) Scan() bool {
+	if lr.err != nil {
+		return false
+	}
+	if lr.recLen > 0 {
+		return lr.readFixed()
+	}
+	if lr.held != nil {
+		if len(lr.blanks) > 0 {
+			lr.nextBlank()
+			return true
+		}
+		lr.cur, *lr.held = *lr.held, lr.cur
+		lr.held = nil
+		return true
+	}
+
+	for {
+		if !lr.readLine() {
+			return false
+		}
+		if lr.mode != CanonicalLines || lr.cur.size > 0 {
+			break
+		}
+		lr.blanks = append(lr.blanks, lr.cur.n)
+	}
+	if len(lr.blanks) > 0 {
+		lr.held = &lineRecord{}
+		lr.cur, *lr.held = *lr.held, lr.cur
+		lr.nextBlank()
+	}
+	return true
+}
+
+// nextBlank makes the first waiting blank line the current record.
+func (lr *lineReader) nextBlank() {
+	// the blank lines immediately precede the held record
+	line := lr.held.line - uint64(len(lr.blanks))
+	lr.cur.reset()
+	lr.cur.line, lr.cur.n, lr.cur.term = line, lr.blanks[0], true
+	lr.blanks = lr.blanks[1:]
+}
+
+// readLine reads the next line into cur. Returns false at the end of the
+// data, if an error occurred, or if a writeBuffer has run out of data
+// part way through a line.
+func (lr *lineReader) readLine() bool {
+	cur := &lr.cur
+	if !cur.partial {
+		cur.reset()
+		cur.line = lr.lines + 1
+	}
+	for {
+		frag, err := lr.r.ReadSlice('\n')
+		if cur.line == 1 && cur.n == 0 && bytes.HasPrefix(frag, utf8BOM) {
+			lr.props.BOM = true
+			if lr.mode == CanonicalLines {
+				cur.n += len(utf8BOM)
+				frag = frag[len(utf8BOM):]
+			}
+		}
+		last := err == nil
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case errNeedMore:
+			lr.add(frag, false)
+			cur.partial = cur.n > 0
+			return false
+		case io.EOF:
+			if cur.n == 0 && len(frag) == 0 {
+				return false
+			}
+			last = true
+		default:
+			lr.err = err
+			return false
+		}
+		lr.add(frag, last)
+		if lr.max > 0 && cur.size > lr.max {
+			lr.err = &RecordTooLongError{Line: cur.line, Limit: lr.max}
+			return false
+		}
+		if last {
+			lr.lines++
+			lr.complete += int64(cur.n)
+			cur.partial = false
+			lr.props.FinalNewline = err == nil
+			if cur.size == 0 {
+				lr.props.TrailingBlankLines++
+			} else {
+				lr.props.TrailingBlankLines = 0
+			}
+			return true
+		}
+	}
+}
+
+// readFixed reads the next fixed-length record into cur. Returns false
+// at the end of the data, if an error occurred (including a truncated
+// final record), or if a writeBuffer has run out of data part way
+// through a record.
+func (lr *lineReader) readFixed() bool {
+	cur := &lr.cur
+	if !cur.partial {
+		cur.reset()
+		cur.line = lr.lines + 1
+	}
+	if cap(cur.rec) < lr.recLen {
+		rec := make([]byte, len(cur.rec), lr.recLen)
+		copy(rec, cur.rec)
+		cur.rec = rec
+	}
+	for len(cur.rec) < lr.recLen {
+		n, err := lr.r.Read(cur.rec[len(cur.rec):lr.recLen])
+		cur.rec = cur.rec[:len(cur.rec)+n]
+		cur.n += n
+		cur.size += n
+		switch err {
+		case nil:
+		case errNeedMore:
+			cur.partial = cur.n > 0
+			return false
+		case io.EOF:
+			if cur.n > 0 {
+				lr.err = &RecordError{Line: cur.line,
+					Err: fmt.Errorf("truncated record of %d bytes, expected %d", cur.n, lr.recLen)}
+			}
+			return false
+		default:
+			lr.err = err
+			return false
+		}
+	}
+	lr.lines++
+	lr.complete += int64(cur.n)
+	cur.partial = false
+	return true
+}
+
+// add adds a fragment of a line to the current record. The last
+// fragment of a terminated line ends with a newline.
+func (lr *lineReader) add(frag []byte, last bool) {
+	cur := &lr.cur
+	cur.n += len(frag)
+
+	lf := last && len(frag) > 0 && frag[len(frag)-1] == '\n'
+	if lf {
+		frag = frag[:len(frag)-1]
+	}
+	crlf := false
+	if cur.cr {
+		// held back from the previous fragment
+		cur.cr = false
+		if last && len(frag) == 0 {
+			crlf = true
+		} else {
+			lr.write([]byte{'\r'})
+		}
+	}
+	if len(frag) > 0 && frag[len(frag)-1] == '\r' {
+		frag = frag[:len(frag)-1]
+		if last {
+			crlf = true
+		} else {
+			cur.cr = true
+		}
+	}
+	lr.write(frag)
+	if !last {
+		return
+	}
+
+	cur.term = lf && lr.mode != ExactLines
+	if lf && crlf {
+		lr.props.CRLF++
+	} else if lf {
+		lr.props.LF++
+	}
+	if lr.mode == ExactLines {
+		// the line terminator is part of the record, but not its size
+		size := cur.size
+		if crlf {
+			lr.write([]byte{'\r'})
+		}
+		if lf {
+			lr.write([]byte{'\n'})
+		}
+		cur.size = size
+	}
+}
+
+// write adds bytes to the current record.
+func (lr *lineReader) write(b []byte) {
+	cur := &lr.cur
+	if len(b) == 0 {
+		return
+	}
+	if cur.digest == nil && lr.max < 0 && len(cur.rec)+len(b) > maxLineLength {
+		if cur.digest = lr.newHash(); cur.digest != nil {
+			cur.digest.Write(cur.rec)
+			cur.rec = cur.rec[:0]
+		}
+	}
+	cur.size += len(b)
+	if cur.digest != nil {
+		cur.digest.Write(b)
+		return
+	}
+	cur.rec = append(cur.rec, b...)
+}
+
+// Bytes returns the current record, or nil if it was streamed.
+func (lr *lineReader) Bytes() []byte {
+	if lr.cur.digest != nil {
+		return nil
+	}
+	return lr.cur.rec
+}
+
+// Err returns the first error other than io.EOF.
+func (lr *lineReader) Err() error {
+	return lr.err
+}
+
+// recordBytes returns the length of the current record of a scanner
+// including its terminator, which is assumed to be a single byte if the
+// scanner is not a lineReader.
+func recordBytes(s recordScanner) int {
+	if lr, ok := s.(*lineReader); ok {
+		return lr.cur.n
+	}
+	return len(s.Bytes()) + 1
+}
+
+// recordLength returns the length of the current record of a scanner,
+// excluding its terminator.
+func recordLength(s recordScanner) int {
+	if lr, ok := s.(*lineReader); ok {
+		return lr.cur.size
+	}
+	return len(s.Bytes())
+}
+
+// recordTerminated reports whether the current record of a scanner was
+// followed by a line terminator which is not included in its Bytes,
+// which is assumed if the scanner is not a lineReader.
+func recordTerminated(s recordScanner) bool {
+	if lr, ok := s.(*lineReader); ok {
+		return lr.cur.term
+	}
+	return true
+}
+
+// recordLine returns the line number of the current record of a
+// scanner, or 0 if it is not a lineReader.
+func recordLine(s recordScanner) uint64 {
+	if lr, ok := s.(*lineReader); ok {
+		return lr.cur.line
+	}
+	return 0
+}
+
+// errNeedMore is returned by a writeBuffer which has run out of data.
+var errNeedMore = errors.New("need more data")
+
+// writeBuffer holds the data passed to Checksummer.Write until it is
+// read by a lineReader. It returns errNeedMore when it runs out of data,
+// until it is closed.
+type writeBuffer struct {
+	bytes.Buffer
+	closed bool
+
+	// tail is the data written after the last complete line, which
+	// Checksummer.pending reads again to include an unterminated record
+	tail    []byte
+	written int64
+}
+
+func (w *writeBuffer) Write(p []byte) (int, error) {
+	w.tail = append(w.tail, p...)
+	w.written += int64(len(p))
+	return w.Buffer.Write(p)
+}
+
+// trim removes the lines which lr has read completely from the tail.
+func (w *writeBuffer) trim(lr *lineReader) {
+	keep := int(w.written - lr.complete)
+	w.tail = append(w.tail[:0], w.tail[len(w.tail)-keep:]...)
+}
+
+func (w *writeBuffer) Read(p []byte) (int, error) {
+	if w.Len() == 0 {
+		if w.closed {
+			return 0, io.EOF
+		}
+		return 0, errNeedMore
+	}
+	return w.Buffer.Read(p)
+}
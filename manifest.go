@@ -0,0 +1,292 @@
+package qcd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Manifest holds QCD checksum information for a dataset made up of
+// several data files, such as the members of an archive.
+type Manifest struct {
+	// Dataset is the checksum information for the dataset as a whole,
+	// see AggregateInfo. For a single data file this is its Info(), plus
+	// a "source_name" if the data was read from standard input under a
+	// logical name.
+	Dataset map[string]string `json:"dataset"`
+
+	// Files is the checksum information for each data file by name,
+	// or nil for a single data file.
+	Files map[string]map[string]string `json:"files,omitempty"`
+}
+
+// ManifestError is returned when QCD checksum information is invalid or
+// can't be used to verify data, as opposed to errors reading the data.
+type ManifestError struct {
+	// Filename is the manifest file, if known.
+	Filename string
+	Err      error
+}
+
+func (e *ManifestError) Error() string {
+	if e.Filename != "" {
+		return e.Filename + ": " + e.Err.Error()
+	}
+	return e.Err.Error()
+}
+
+func (e *ManifestError) Unwrap() error {
+	return e.Err
+}
+
+// NewManifest creates a Manifest for the checksum information of several
+// data files, and computes their aggregate information.
+func NewManifest(files map[string]map[string]string) (*Manifest, error) {
+	agg, err := AggregateInfo(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{Dataset: agg, Files: files}, nil
+}
+
+// hashingKeys are the Info() keys which determine how records are
+// hashed, so must be the same for every file of a dataset.
+var hashingKeys = []string{"hash_algorithm", "mask_regex", "mask_replacement", "key_id",
+	"line_mode", "record_format", "json_include", "json_exclude", "record_layout"}
+
+// AggregateInfo combines the checksum information of several data files.
+// The aggregate content_hash is the XOR of each file's content_hash, and
+// total_records (and bytes_read) the sum of each file's, so that they
+// are equal to the checksum of all the files' records read in any order.
+// All files must hash their records in the same way (see hashingKeys).
+func AggregateInfo(files map[string]map[string]string) (map[string]string, error) {
+	var sum [32]byte
+	var nrecs, nbytes int64
+	hasBytes := true
+	partial := false
+	maxRecord := 0
+	var first map[string]string
+	var firstName string
+	for name, info := range files {
+		if first == nil {
+			first, firstName = info, name
+		}
+		for _, k := range hashingKeys {
+			if info[k] != first[k] {
+				return nil, fmt.Errorf("%s and %s have different %s", firstName, name, k)
+			}
+		}
+
+		h, err := hex.DecodeString(info["content_hash"])
+		if err != nil || len(h) != len(sum) {
+			return nil, fmt.Errorf("%s: invalid content_hash", name)
+		}
+		xorBytes(sum[:], sum[:], h)
+
+		nr, err := strconv.ParseInt(info["total_records"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid total_records", name)
+		}
+		nrecs += nr
+
+		nb, err := strconv.ParseInt(info["bytes_read"], 10, 64)
+		if err != nil {
+			// older manifests don't record bytes_read
+			hasBytes = false
+		}
+		nbytes += nb
+		if info["partial"] == "true" {
+			partial = true
+		}
+		n, err := parseRecordLimit(info["max_record_length"])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		maxRecord = widerRecordLimit(maxRecord, n)
+	}
+
+	r := map[string]string{
+		"when_checked":   time.Now().UTC().Format(time.RFC3339),
+		"content_hash":   fmt.Sprintf("%064x", sum),
+		"total_records":  fmt.Sprint(nrecs),
+		"total_files":    fmt.Sprint(len(files)),
+		"hash_algorithm": DefaultHasher,
+	}
+	if hasBytes {
+		r["bytes_read"] = fmt.Sprint(nbytes)
+	}
+	if partial {
+		r["partial"] = "true"
+	}
+	if maxRecord != 0 {
+		r["max_record_length"] = formatRecordLimit(maxRecord)
+	}
+	for _, k := range hashingKeys {
+		if first[k] != "" {
+			r[k] = first[k]
+		}
+	}
+	return r, nil
+}
+
+// ReadManifest loads QCD checksum information from a file, which may
+// hold either a Manifest or the Info() of a single data file. Returns a
+// ManifestError if the file could be read but is not a valid manifest.
+func ReadManifest(filename string) (*Manifest, error) {
+	vb, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(vb)
+	if err != nil {
+		return nil, &ManifestError{Filename: filename, Err: err}
+	}
+	return m, nil
+}
+
+func parseManifest(vb []byte) (*Manifest, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(vb, &raw); err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if _, ok := raw["files"]; ok {
+		err := json.Unmarshal(vb, m)
+		return m, err
+	}
+	err := json.Unmarshal(vb, &m.Dataset)
+	return m, err
+}
+
+// WriteTo writes the manifest as JSON. A manifest for a single data file
+// is written as just its checksum information.
+func (m *Manifest) WriteTo(w io.Writer) (int64, error) {
+	var v interface{} = m
+	if m.Files == nil {
+		v = m.Dataset
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+// WriteFile writes the manifest to the named file.
+func (m *Manifest) WriteFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = m.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// FileResult is the outcome of checksumming or verifying one data file
+// of a dataset.
+type FileResult struct {
+	// Name is the file's name in the manifest.
+	Name string
+
+	// Info is the file's checksum information, when checksumming.
+	Info map[string]string
+
+	// OK is true if the file's content hash matched the manifest,
+	// when verifying.
+	OK bool
+
+	// Unverified is the number of records not found in the file's
+	// records_hash, when verification failed.
+	Unverified int
+
+	// Err is set if the file could not be read or verified.
+	Err error
+}
+
+// SumFiles computes the checksum information of data files in parallel,
+// using up to workers goroutines (runtime.NumCPU() if 0). Each file uses
+// a new Checksummer from newChecksummer. Names are slash-separated and
+// relative to dir. Results are in the same order as names.
+func SumFiles(dir string, names []string, newChecksummer func() *Checksummer, workers int) []FileResult {
+	results := make([]FileResult, len(names))
+	forEachFile(len(names), workers, func(i int) {
+		res := &results[i]
+		res.Name = names[i]
+		in, err := OpenInput(filepath.Join(dir, filepath.FromSlash(names[i])))
+		if err != nil {
+			res.Err = err
+			return
+		}
+		defer in.Close()
+		ck := newChecksummer()
+		if res.Err = ck.Sum(in); res.Err == nil {
+			res.Info = ck.Info()
+		}
+	})
+	return results
+}
+
+// VerifyFiles verifies the data files listed in the manifest in parallel,
+// using up to workers goroutines (runtime.NumCPU() if 0). Names are
+// relative to dir. Results are sorted by name.
+func (m *Manifest) VerifyFiles(dir string, key []byte, workers int) []FileResult {
+	names := make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]FileResult, len(names))
+	forEachFile(len(names), workers, func(i int) {
+		res := &results[i]
+		res.Name = names[i]
+		in, err := OpenInput(filepath.Join(dir, filepath.FromSlash(names[i])))
+		if err != nil {
+			res.Err = err
+			return
+		}
+		defer in.Close()
+		ck := &Checksummer{}
+		if res.Err = ck.SetKey(key); res.Err != nil {
+			return
+		}
+		res.OK, res.Unverified, res.Err = ck.Verify(in, m.Files[names[i]])
+	})
+	return results
+}
+
+// forEachFile calls fn for 0..n-1 using up to workers goroutines.
+func forEachFile(n, workers int, fn func(i int)) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
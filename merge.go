@@ -0,0 +1,210 @@
+package qcd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MergeConflict is a row which both sides changed differently from the
+// base, when merging by key. A nil row was deleted (or never added).
+type MergeConflict struct {
+	Key    []string `json:"key"`
+	Base   *string  `json:"base"`
+	Theirs *string  `json:"theirs"`
+	Ours   *string  `json:"ours"`
+}
+
+// MergeResult contains the records of a three-way merge.
+type MergeResult struct {
+	// Records are the merged (unmasked) records. Where there was a
+	// conflict, our version of the row is used.
+	Records []string
+
+	// Conflicts are the rows changed differently by both sides. Only
+	// rows merged by key can conflict.
+	Conflicts []MergeConflict
+
+	// records are framed by length, without line terminators
+	framed bool
+}
+
+// WriteTo writes the merged records to w, each followed by a newline
+// unless it already ends with one (see ExactLines) or the records are
+// framed by length (see Layout.RecordLength).
+func (r *MergeResult) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int
+	for _, rec := range r.Records {
+		m, _ := bw.WriteString(rec)
+		n += m
+		if !r.framed && !strings.HasSuffix(rec, "\n") {
+			bw.WriteByte('\n')
+			n++
+		}
+	}
+	return int64(n), bw.Flush()
+}
+
+// Merge3 merges the changes made to the records of base by theirs and
+// ours. Records are compared as a multiset: a record added or removed on
+// one side only is added or removed from the result, and a record added
+// or removed by both sides is only added or removed once. All three
+// sources must use the same mask.
+//
+// Records of base are kept in their original order, followed by the
+// records added by ours and then by theirs.
+func Merge3(base, theirs, ours *Source) (*MergeResult, error) {
+	if err := base.checkMasks(theirs); err != nil {
+		return nil, err
+	}
+	if err := base.checkMasks(ours); err != nil {
+		return nil, err
+	}
+
+	b, t, o := countRecords(base), countRecords(theirs), countRecords(ours)
+	want := make(map[string]int)
+	for _, counts := range []map[string]int{b, t, o} {
+		for rec := range counts {
+			if _, ok := want[rec]; !ok {
+				want[rec] = mergeCount(b[rec], t[rec], o[rec])
+			}
+		}
+	}
+
+	res := &MergeResult{framed: base.framed()}
+	for _, s := range []*Source{base, ours, theirs} {
+		for i, line := range s.lines {
+			if want[line] > 0 {
+				want[line]--
+				res.Records = append(res.Records, s.rawRecord(i))
+			}
+		}
+	}
+	return res, nil
+}
+
+// mergeCount returns the number of copies of a record in the merged
+// result, given the number in the base, theirs and ours.
+func mergeCount(b, t, o int) int {
+	dt, do := t-b, o-b
+	switch {
+	case dt == 0:
+		return o
+	case do == 0:
+		return t
+	case dt > 0 && do > 0:
+		// both sides added copies, keep the larger addition
+		if t > o {
+			return t
+		}
+		return o
+	case dt < 0 && do < 0:
+		// both sides removed copies, keep the larger removal
+		if t < o {
+			return t
+		}
+		return o
+	}
+	if n := b + dt + do; n > 0 {
+		return n
+	}
+	return 0
+}
+
+func countRecords(s *Source) map[string]int {
+	counts := make(map[string]int)
+	for _, line := range s.lines {
+		counts[line]++
+	}
+	return counts
+}
+
+// Merge3ByKey merges the changes made to the rows of base by theirs and
+// ours as delimited data, matching rows by the values in the key
+// columns. A row changed (or deleted) by one side only takes that
+// side's version, and a row changed identically by both sides is used
+// as-is. Rows changed differently by both sides are reported as
+// conflicts, and our version is used in the result.
+//
+// Keys must be unique within each source. With opts.Header, our header
+// row is used in the result.
+func Merge3ByKey(base, theirs, ours *Source, opts KeyDiffOptions) (*MergeResult, error) {
+	if err := base.checkMasks(theirs); err != nil {
+		return nil, err
+	}
+	if err := base.checkMasks(ours); err != nil {
+		return nil, err
+	}
+
+	sources := []*Source{base, theirs, ours}
+	keyed := make([]*keyedRows, len(sources))
+	for i, s := range sources {
+		kr, err := parseKeyedRows(s, opts)
+		if err != nil {
+			return nil, err
+		}
+		if dups := kr.duplicates(s.Filename); len(dups) > 0 {
+			return nil, fmt.Errorf("%s: duplicate key (%s) in %d rows, cannot merge by key",
+				s.Filename, strings.Join(dups[0].Key, ","), dups[0].Rows)
+		}
+		keyed[i] = kr
+	}
+
+	res := &MergeResult{framed: base.framed()}
+	if opts.Header && len(ours.lines) > 0 {
+		res.Records = append(res.Records, ours.rawRecord(0))
+	}
+
+	// row returns the masked and raw record for a key in source i
+	row := func(i int, k string) (*string, *string) {
+		idx, ok := keyed[i].index[k]
+		if !ok {
+			return nil, nil
+		}
+		masked := sources[i].lines[idx[0]]
+		raw := sources[i].rawRecord(idx[0])
+		return &masked, &raw
+	}
+
+	seen := make(map[string]bool)
+	for _, i := range []int{0, 2, 1} {
+		for _, k := range keyed[i].order {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+
+			bm, _ := row(0, k)
+			tm, traw := row(1, k)
+			om, oraw := row(2, k)
+			var merged *string
+			switch {
+			case sameRow(tm, bm):
+				merged = oraw
+			case sameRow(om, bm), sameRow(tm, om):
+				merged = traw
+			default:
+				_, braw := row(0, k)
+				res.Conflicts = append(res.Conflicts, MergeConflict{
+					Key:  keyed[i].key(keyed[i].rows[k][0]),
+					Base: braw, Theirs: traw, Ours: oraw,
+				})
+				merged = oraw
+			}
+			if merged != nil {
+				res.Records = append(res.Records, *merged)
+			}
+		}
+	}
+	return res, nil
+}
+
+// sameRow returns true if both rows are absent or have the same content.
+func sameRow(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,370 @@
+package qcd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// patchMagic starts the header line of a patch file.
+const patchMagic = "#qcdp "
+
+// Patch is a portable edit script that turns the records of a base data
+// source into the records of a target, ignoring their order. It carries
+// the content hashes of both so that the result can be verified.
+type Patch struct {
+	// BaseHash is the content hash of the records the patch applies to.
+	BaseHash string `json:"base_hash"`
+
+	// TargetHash is the expected content hash after applying the patch.
+	TargetHash string `json:"target_hash"`
+
+	// options used to compute the content hashes
+	HashAlgorithm   string `json:"hash_algorithm"`
+	KeyID           string `json:"key_id,omitempty"`
+	MaskRegex       string `json:"mask_regex,omitempty"`
+	MaskReplacement string `json:"mask_replacement,omitempty"`
+
+	// how the data is split into records, and their format
+	LineMode LineMode     `json:"line_mode,omitempty"`
+	JSON     *JSONOptions `json:"json,omitempty"`
+	Layout   *Layout      `json:"layout,omitempty"`
+
+	// MaxRecordLength is the longest record in bytes, 0 for no limit,
+	// or DefaultMaxRecordLength if nil.
+	MaxRecordLength *int `json:"max_record_length,omitempty"`
+
+	// Add contains the (unmasked) records to add. In the patch file,
+	// records are quoted if they may contain line terminators (see
+	// ExactLines and Layout.RecordLength).
+	Add []string `json:"-"`
+
+	// Delete contains the (masked) records to delete.
+	Delete []string `json:"-"`
+}
+
+// MakePatch creates a Patch which turns the records of this source into
+// those of the target. Both sources must use the same mask.
+func (s *Source) MakePatch(target *Source) (*Patch, error) {
+	if err := s.checkMasks(target); err != nil {
+		return nil, err
+	}
+	rx, repl := s.Mask()
+	p := &Patch{
+		HashAlgorithm:   target.ck.hasher.Name(),
+		KeyID:           target.ck.keyID,
+		MaskRegex:       rx,
+		MaskReplacement: repl,
+		LineMode:        target.ck.lineMode,
+		JSON:            target.jsonOptions(),
+		Layout:          target.recordLayout(),
+	}
+	if n := widerRecordLimit(s.ck.maxRecord, target.ck.maxRecord); n != 0 {
+		if n < 0 {
+			n = 0
+		}
+		p.MaxRecordLength = &n
+	}
+	baseCk, err := p.checksummer(target.key)
+	if err != nil {
+		return nil, err
+	}
+	targetCk, _ := p.checksummer(target.key)
+
+	counts := make(map[string]int)
+	for _, line := range target.lines {
+		counts[line]++
+		targetCk.addRecord([]byte(line))
+	}
+	for _, line := range s.lines {
+		baseCk.addRecord([]byte(line))
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		p.Delete = append(p.Delete, line)
+	}
+
+	counts = make(map[string]int)
+	for _, line := range s.lines {
+		counts[line]++
+	}
+	for i, line := range target.lines {
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		p.Add = append(p.Add, target.rawRecord(i))
+	}
+
+	p.BaseHash = fmt.Sprintf("%064x", baseCk.sum)
+	p.TargetHash = fmt.Sprintf("%064x", targetCk.sum)
+	return p, nil
+}
+
+// checksummer returns a Checksummer configured the same as the patch.
+func (p *Patch) checksummer(key []byte) (*Checksummer, error) {
+	ck := &Checksummer{}
+	err := ck.SetHasher(p.HashAlgorithm)
+	if err == nil {
+		err = ck.SetKey(key)
+	}
+	if err == nil && p.MaskRegex != "" {
+		err = ck.SetRegex(p.MaskRegex, p.MaskReplacement)
+	}
+	if err == nil {
+		err = ck.SetLineMode(p.LineMode)
+	}
+	if err == nil {
+		err = ck.SetJSON(p.JSON)
+	}
+	if err == nil {
+		err = ck.SetLayout(p.Layout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ck.SetMaxRecordLength(p.maxRecordLength())
+	if ck.keyID != p.KeyID {
+		if p.KeyID == "" {
+			return nil, fmt.Errorf("patch was not created with a key")
+		}
+		return nil, fmt.Errorf("patch requires key %s", p.KeyID)
+	}
+	ck.recHashes = newQuickSum(DisableQuickSums)
+	return ck, nil
+}
+
+// WriteTo writes the patch to w. The first line is a header containing
+// the patch's hashes and options, followed by one line per record
+// prefixed with "-" (delete) or "+" (add).
+func (p *Patch) WriteTo(w io.Writer) (int64, error) {
+	hdr, err := json.Marshal(p)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(w)
+	n, _ := bw.WriteString(patchMagic)
+	m, _ := bw.Write(hdr)
+	n += m
+	bw.WriteByte('\n')
+	n++
+	for _, rec := range p.Delete {
+		m, _ = bw.WriteString("-" + p.quote(rec) + "\n")
+		n += m
+	}
+	for _, rec := range p.Add {
+		m, _ = bw.WriteString("+" + p.quote(rec) + "\n")
+		n += m
+	}
+	return int64(n), bw.Flush()
+}
+
+// quoted returns true if the records may contain line terminators, so
+// are quoted in the patch file.
+func (p *Patch) quoted() bool {
+	return p.LineMode == ExactLines || p.framed()
+}
+
+// maxRecordLength returns the patch's record length limit, as passed to
+// SetMaxRecordLength.
+func (p *Patch) maxRecordLength() int {
+	switch {
+	case p.MaxRecordLength == nil:
+		return 0
+	case *p.MaxRecordLength == 0:
+		return UnlimitedRecordLength
+	}
+	return *p.MaxRecordLength
+}
+
+// framed returns true if records are framed by length rather than lines.
+func (p *Patch) framed() bool {
+	return p.Layout != nil && p.Layout.RecordLength > 0
+}
+
+func (p *Patch) quote(record string) string {
+	if p.quoted() {
+		return strconv.Quote(record)
+	}
+	return record
+}
+
+// ReadPatch reads a patch previously written by Patch.WriteTo. Records
+// longer than the patch's MaxRecordLength return a RecordTooLongError.
+func ReadPatch(r io.Reader) (*Patch, error) {
+	br := bufio.NewReader(r)
+	header, err := readPatchLine(br)
+	if err == io.EOF {
+		return nil, fmt.Errorf("empty patch file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(header, patchMagic) {
+		return nil, fmt.Errorf("not a qcd patch file")
+	}
+	p := &Patch{}
+	if err = json.Unmarshal([]byte(header[len(patchMagic):]), p); err != nil {
+		return nil, fmt.Errorf("invalid patch header: %s", err.Error())
+	}
+	max := p.maxRecordLength()
+	if max == 0 {
+		max = DefaultMaxRecordLength
+	}
+
+	for n := uint64(2); ; n++ {
+		line, err := readPatchLine(br)
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec := ""
+		if len(line) > 0 {
+			rec = line[1:]
+		}
+		if p.quoted() {
+			if rec, err = strconv.Unquote(rec); err != nil {
+				return nil, fmt.Errorf("invalid patch record: %q", line)
+			}
+		}
+		if max > 0 && len(trimTerminator([]byte(rec))) > max {
+			return nil, &RecordTooLongError{Line: n, Limit: max}
+		}
+		switch {
+		case strings.HasPrefix(line, "-"):
+			p.Delete = append(p.Delete, rec)
+		case strings.HasPrefix(line, "+"):
+			p.Add = append(p.Add, rec)
+		default:
+			return nil, fmt.Errorf("invalid patch record: %q", line)
+		}
+	}
+}
+
+// readPatchLine reads a line of a patch file, of any length, without its
+// newline. Returns io.EOF if there are no more lines.
+func readPatchLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	// a carriage return is part of the record
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+// Apply reads base records from r and writes the patched records to w.
+// Records are read in the same way as the sources of the patch, and
+// those which are not deleted are written in their original order,
+// followed by the added records. Returns an error if r does not match
+// the patch's base, or if the result does not match its target hash
+// (see PatchMismatchError).
+//
+// The patched records are held in a temporary file until both hashes
+// have been checked, so nothing is written to w if the patch does not
+// apply. The output is only complete if the error is nil.
+func (p *Patch) Apply(r io.Reader, w io.Writer, key []byte) error {
+	baseCk, err := p.checksummer(key)
+	if err != nil {
+		return err
+	}
+	ck, _ := p.checksummer(key)
+
+	del := make(map[string]int)
+	for _, rec := range p.Delete {
+		del[rec]++
+	}
+
+	tmp, err := ioutil.TempFile("", "qcdpatch")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	bw := bufio.NewWriter(tmp)
+	s := newRecordReader(ck, r)
+	for s.Scan() {
+		record, err := ck.normalize(s.Bytes())
+		if err != nil {
+			return &RecordError{Line: s.cur.line, Err: err}
+		}
+		baseCk.addRecord(record)
+		if del[string(record)] > 0 {
+			del[string(record)]--
+			continue
+		}
+		ck.addRecord(record)
+		writeRecord(bw, s.Bytes(), p.framed())
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+	for _, rec := range p.Add {
+		record, err := ck.normalize([]byte(rec))
+		if err != nil {
+			return fmt.Errorf("invalid patch record: %s", err.Error())
+		}
+		ck.addRecord(record)
+		writeRecord(bw, []byte(rec), p.framed())
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	if p.BaseHash != fmt.Sprintf("%064x", baseCk.sum) {
+		return &PatchMismatchError{}
+	}
+	if p.TargetHash != fmt.Sprintf("%064x", ck.sum) {
+		return &PatchMismatchError{Target: true}
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, tmp)
+	return err
+}
+
+// PatchMismatchError is returned by Apply when the base data, or the
+// patched result, does not have the content hash in the patch.
+type PatchMismatchError struct {
+	// Target is true if the patched result did not match, or false if
+	// the patch does not apply to the base data.
+	Target bool
+}
+
+func (e *PatchMismatchError) Error() string {
+	if e.Target {
+		return "patched content hash does not match the patch target"
+	}
+	return "patch does not apply: base content hash does not match"
+}
+
+// writeRecord writes a record followed by a newline, unless it already
+// ends with one (see ExactLines) or records are framed by length.
+func writeRecord(w *bufio.Writer, record []byte, framed bool) {
+	w.Write(record)
+	if !framed && !bytes.HasSuffix(record, []byte{'\n'}) {
+		w.WriteByte('\n')
+	}
+}
+
+// ApplyFile applies the patch to a (possibly compressed) base data file,
+// see Apply for details.
+func (p *Patch) ApplyFile(baseFilename string, w io.Writer, key []byte) error {
+	in, err := OpenInput(baseFilename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return p.Apply(in, w, key)
+}
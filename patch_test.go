@@ -0,0 +1,150 @@
+package qcd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// roundTrip makes a patch from base to target, writes and reads it back,
+// and applies it to base. Returns the patched data.
+func roundTrip(t *testing.T, base, target string, newCk func() *Checksummer) string {
+	t.Helper()
+	dir := t.TempDir()
+	bfn := writeSource(t, dir, "base", base, newCk())
+	tfn := writeSource(t, dir, "target", target, newCk())
+
+	bs, err := NewSource(bfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewSource(tfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := bs.MakePatch(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err = p.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	p, err = ReadPatch(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err = p.ApplyFile(bfn, out, nil); err != nil {
+		t.Fatalf("Apply: %s", err.Error())
+	}
+	return out.String()
+}
+
+func TestApplyJSON(t *testing.T) {
+	newCk := func() *Checksummer {
+		ck := &Checksummer{}
+		ck.SetJSON(&JSONOptions{Exclude: []string{"/ts"}})
+		return ck
+	}
+	base := "{\"b\":2, \"a\":1}\n{\"a\":3,\"ts\":1}\n"
+	target := "{\"a\":1,\"b\":2.0}\n{\"a\":4}\n{\"ts\":9,\"a\":3}\n"
+	got := roundTrip(t, base, target, newCk)
+	want := "{\"b\":2, \"a\":1}\n{\"a\":3,\"ts\":1}\n{\"a\":4}\n"
+	if got != want {
+		t.Errorf("patched data = %q, want %q", got, want)
+	}
+}
+
+func TestApplyFixedLength(t *testing.T) {
+	newCk := func() *Checksummer {
+		ck := &Checksummer{}
+		ck.SetLayout(&Layout{
+			RecordLength: 6,
+			Fields:       []LayoutField{{Name: "id", Offset: 0, Length: 2}, {Name: "v", Offset: 2, Length: 4}},
+		})
+		return ck
+	}
+	base := "01aaaa02b\nbb03cccc"
+	target := "01aaaa03cccc04d\r\nd"
+	if got := roundTrip(t, base, target, newCk); got != target {
+		t.Errorf("patched data = %q, want %q", got, target)
+	}
+}
+
+func TestApplyExactLines(t *testing.T) {
+	newCk := func() *Checksummer {
+		ck := &Checksummer{}
+		ck.SetLineMode(ExactLines)
+		return ck
+	}
+	base := "a\r\nb\n"
+	target := "a\r\nb\nc\r\n"
+	if got := roundTrip(t, base, target, newCk); got != target {
+		t.Errorf("patched data = %q, want %q", got, target)
+	}
+}
+
+func TestApplyUnlimitedRecords(t *testing.T) {
+	newCk := func() *Checksummer {
+		ck := &Checksummer{}
+		ck.SetMaxRecordLength(UnlimitedRecordLength)
+		return ck
+	}
+	long := strings.Repeat("x", DefaultMaxRecordLength+10)
+	base := "a\n" + long + "\n"
+	target := "a\n" + long + "\n" + long + "y\n"
+	if got := roundTrip(t, base, target, newCk); got != target {
+		t.Errorf("patched data is %d bytes, want %d", len(got), len(target))
+	}
+
+	dir := t.TempDir()
+	left := writeSource(t, dir, "left", base, newCk())
+	right := writeSource(t, dir, "right", target, newCk())
+	sd := &StreamDiff{TempDir: dir, Partitions: 4}
+	sum, err := sd.DiffTo(left, right, DiscardDiffSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Added != 1 || sum.Removed != 0 {
+		t.Errorf("StreamDiff: %s, want 1 added", sum)
+	}
+}
+
+func TestApplyWrongBase(t *testing.T) {
+	dir := t.TempDir()
+	newCk := func() *Checksummer { return &Checksummer{} }
+	bfn := writeSource(t, dir, "base", "a\nb\n", newCk())
+	tfn := writeSource(t, dir, "target", "a\nc\n", newCk())
+	bs, err := NewSource(bfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewSource(tfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := bs.MakePatch(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	err = p.Apply(strings.NewReader("a\nb\nx\n"), out, nil)
+	if pm, ok := err.(*PatchMismatchError); !ok || pm.Target {
+		t.Fatalf("Apply to the wrong base: %v, want a base PatchMismatchError", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Apply to the wrong base wrote %q, want nothing", out.String())
+	}
+}
+
+func TestApplyCarriageReturn(t *testing.T) {
+	newCk := func() *Checksummer { return &Checksummer{} }
+	// the record added is "a\r", as only one CR is removed before a LF
+	got := roundTrip(t, "x\n", "x\na\r\r\n", newCk)
+	if want := "x\na\r\n"; got != want {
+		t.Errorf("patched data = %q, want %q", got, want)
+	}
+}
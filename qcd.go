@@ -4,13 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"math"
-	"os"
+	"math/bits"
 	"regexp"
 	"time"
 )
@@ -27,8 +30,56 @@ type Checksummer struct {
 
 	recHashes quickSum
 	nrecs     uint64
+	// set if a scan was cancelled part-way through
+	partial bool
 
-	vout io.Writer
+	hasher Hasher
+
+	// keyed record hashing (HMAC)
+	key   []byte
+	keyID string
+	mac   hash.Hash
+
+	vout       io.Writer
+	unverified func(UnverifiedRecord)
+
+	// records passed to Write
+	wbuf *writeBuffer
+	wr   *lineReader
+
+	lineMode LineMode
+	// JSON record format, or nil
+	json *jsonFormat
+	// fixed-width record layout, or nil
+	layout *layoutFormat
+	// line structure of the data read by Sum, Verify or Write
+	props *InputProperties
+
+	// maximum record length, see SetMaxRecordLength
+	maxRecord int
+
+	// progress reporting
+	nbytes    uint64
+	start     time.Time
+	elapsed   time.Duration
+	progress  func(Progress)
+	pRecs     uint64
+	pBytes    uint64
+	nextRecs  uint64
+	nextBytes uint64
+}
+
+// Progress describes how much data a Checksummer has processed.
+type Progress struct {
+	// Records is the number of records checksummed or verified.
+	Records uint64
+	// Bytes is the number of (decompressed) bytes read, including line
+	// terminators.
+	Bytes uint64
+	// Elapsed is the time spent summing or verifying.
+	Elapsed time.Duration
+	// Done is true for the final report at the end of the data.
+	Done bool
 }
 
 // SetVerbose enables/disables verbose output.
@@ -36,6 +87,197 @@ func (c *Checksummer) SetVerbose(w io.Writer) {
 	c.vout = w
 }
 
+// UnverifiedRecord describes a record which was not found in the
+// records_hash during verification.
+type UnverifiedRecord struct {
+	// Line is the line number of the record, starting at 1.
+	Line uint64
+	// Offset is the byte offset of the start of the record in the
+	// (decompressed) data.
+	Offset uint64
+	// Length is the length of the record in bytes, excluding its line
+	// terminator.
+	Length int
+	// Hash is the record's hash, after any mask was applied.
+	Hash [sha256.Size]byte
+	// Record is the record as it was read, before any mask was applied.
+	// It is only valid until the callback returns, and is nil for records
+	// which were too long to hold in memory (see SetMaxRecordLength). In
+	// ExactLines mode it includes the line terminator.
+	Record []byte
+	// Terminated is true if the record was followed by a line terminator
+	// which is not included in Record. It is false in ExactLines mode,
+	// for fixed-length records (see Layout), and for a final record
+	// without a newline.
+	Terminated bool
+	// Err is set if the record is not valid in the record format (e.g.
+	// invalid JSON), in which case Hash is the hash of the record as read.
+	Err error
+}
+
+// SetUnverified calls fn for each record which is not found in the
+// records_hash during verification. A nil fn disables the callback.
+func (c *Checksummer) SetUnverified(fn func(UnverifiedRecord)) {
+	c.unverified = fn
+}
+
+// SetProgress calls fn every nrecs records or nbytes bytes, whichever
+// comes first (0 disables either), while summing or verifying, and once
+// more at the end of the data. A nil fn disables progress reporting.
+func (c *Checksummer) SetProgress(nrecs, nbytes uint64, fn func(Progress)) {
+	c.progress = fn
+	c.pRecs, c.pBytes = nrecs, nbytes
+	c.nextRecs, c.nextBytes = c.nrecs+nrecs, c.nbytes+nbytes
+}
+
+// Progress returns how much data has been processed so far.
+func (c *Checksummer) Progress() Progress {
+	p := Progress{Records: c.nrecs, Bytes: c.nbytes, Elapsed: c.elapsed}
+	if !c.start.IsZero() {
+		p.Elapsed += time.Since(c.start)
+	}
+	return p
+}
+
+// begin starts timing a scan, unless records added by Write or
+// AddRecord are already being timed.
+func (c *Checksummer) begin() {
+	if c.start.IsZero() {
+		c.start = time.Now()
+	}
+}
+
+// end stops timing a scan, and makes the final progress report.
+func (c *Checksummer) end() {
+	c.elapsed += time.Since(c.start)
+	c.start = time.Time{}
+	if c.progress != nil {
+		p := c.Progress()
+		p.Done = true
+		c.progress(p)
+	}
+}
+
+// scanned counts a record of n bytes (including its terminator), and
+// reports progress if due.
+func (c *Checksummer) scanned(n int) {
+	c.nbytes += uint64(n)
+	if c.progress == nil {
+		return
+	}
+	if (c.pRecs > 0 && c.nrecs >= c.nextRecs) || (c.pBytes > 0 && c.nbytes >= c.nextBytes) {
+		c.nextRecs, c.nextBytes = c.nrecs+c.pRecs, c.nbytes+c.pBytes
+		c.progress(c.Progress())
+	}
+}
+
+// SetMaxRecordLength sets the longest record, in bytes excluding the
+// line terminator, which Sum, Verify and Write will accept before
+// returning a RecordTooLongError. Zero restores DefaultMaxRecordLength,
+// or the limit stored in the verification data when verifying.
+// A limit other than zero is stored in Info().
+// With UnlimitedRecordLength, records longer than the default are hashed
+// as they are read rather than held in memory, unless a regex mask must
+// be applied to them.
+func (c *Checksummer) SetMaxRecordLength(n int) {
+	c.maxRecord = n
+}
+
+// SetLineMode selects how data is split into records, see LineModes.
+// The mode is stored in Info(), and used when verifying.
+func (c *Checksummer) SetLineMode(mode LineMode) error {
+	if !mode.valid() {
+		return fmt.Errorf("unknown line mode '%s'", mode)
+	}
+	c.lineMode = mode
+	return nil
+}
+
+// newScanner returns a lineReader for the Checksummer's options.
+func (c *Checksummer) newScanner(r io.Reader) *lineReader {
+	lr := newLineReader(r, 0, DefaultLines, func() hash.Hash {
+		if c.replacer != nil || c.json != nil || c.layout != nil {
+			return nil
+		}
+		return c.newRecordHash()
+	})
+	c.setupScanner(lr)
+	return lr
+}
+
+// setupScanner sets how a lineReader splits data into records: its line
+// mode, maximum record length, and the record length of a layout.
+func (c *Checksummer) setupScanner(lr *lineReader) {
+	lr.mode, lr.max, lr.recLen = c.lineMode, c.maxRecord, 0
+	if lr.max == 0 {
+		lr.max = DefaultMaxRecordLength
+	}
+	if c.layout != nil {
+		lr.recLen = c.layout.layout.RecordLength
+	}
+	if lr.in != nil {
+		lr.in.framed = lr.recLen > 0
+	}
+}
+
+// SetJSON selects the JSON record format, in which each record is a JSON
+// value that is checksummed in its canonical form (RFC 8785), so that the
+// checksum does not depend on the order of object members, whitespace or
+// how numbers and strings are written. The options are stored in Info(),
+// and used when verifying. A nil opts selects plain records.
+func (c *Checksummer) SetJSON(opts *JSONOptions) error {
+	if opts == nil {
+		c.json = nil
+		return nil
+	}
+	if c.layout != nil {
+		return fmt.Errorf("the JSON record format cannot be used with a layout")
+	}
+	f, err := newJSONFormat(opts)
+	if err != nil {
+		return err
+	}
+	c.json = f
+	return nil
+}
+
+// SetLayout selects the fixed-width record format, in which only the
+// fields of the layout which are included and not masked are checksummed.
+// If the layout has a RecordLength, records are read by length rather
+// than by line, and the LineMode is not used. The layout is stored in
+// Info(), and used when verifying. A nil layout selects plain records.
+func (c *Checksummer) SetLayout(l *Layout) error {
+	if l == nil {
+		c.layout = nil
+		return nil
+	}
+	if c.json != nil {
+		return fmt.Errorf("a layout cannot be used with the JSON record format")
+	}
+	lf, err := newLayoutFormat(l)
+	if err != nil {
+		return err
+	}
+	c.layout = lf
+	return nil
+}
+
+// RecordError is returned when a record cannot be read in the record
+// format, e.g. a record which is not valid JSON.
+type RecordError struct {
+	// Line is the line number of the record.
+	Line uint64
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
 // SetRegex sets a regular expression that will be
 // replaced for every input record.
 func (c *Checksummer) SetRegex(regex, replacement string) (err error) {
@@ -46,32 +288,343 @@ func (c *Checksummer) SetRegex(regex, replacement string) (err error) {
 	return
 }
 
+// SetHasher selects the algorithm used to hash individual records,
+// see HasherNames for the available choices.
+func (c *Checksummer) SetHasher(name string) error {
+	h, err := NewHasher(name)
+	if err != nil {
+		return err
+	}
+	if c.key != nil && !h.Cryptographic() {
+		return fmt.Errorf("record hash algorithm '%s' cannot be used with a key", name)
+	}
+	c.hasher = h
+	c.mac = nil
+	return nil
+}
+
+// SetKey enables keyed record hashing using an HMAC of the record hash
+// algorithm with the provided secret. Only a key identifier is stored in
+// Info(), so the records_hash cannot be used to test for the presence of
+// a record without the key. A nil or empty key disables keyed hashing.
+func (c *Checksummer) SetKey(key []byte) error {
+	c.mac = nil
+	if len(key) == 0 {
+		c.key = nil
+		c.keyID = ""
+		return nil
+	}
+	if c.hasher != nil && !c.hasher.Cryptographic() {
+		return fmt.Errorf("record hash algorithm '%s' cannot be used with a key", c.hasher.Name())
+	}
+	c.key = key
+	c.keyID = KeyID(key)
+	return nil
+}
+
+// KeyID returns the identifier that is stored in the manifest for
+// records hashed using the provided key.
+func KeyID(key []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("qcd key identifier"))
+	return fmt.Sprintf("%x", m.Sum(nil)[:8])
+}
+
+// hashRecord returns the hash of a single (masked) record.
+func (c *Checksummer) hashRecord(record []byte) (h [sha256.Size]byte) {
+	if c.hasher == nil {
+		c.hasher = hashers[DefaultHasher]
+	}
+	if c.key == nil {
+		return c.hasher.Sum256(record)
+	}
+	if c.mac == nil {
+		c.mac = hmac.New(c.hasher.New, c.key)
+	}
+	c.mac.Reset()
+	c.mac.Write(record)
+	c.mac.Sum(h[:0])
+	return h
+}
+
+// newRecordHash returns a streaming hash for a single (masked) record,
+// equivalent to hashRecord.
+func (c *Checksummer) newRecordHash() hash.Hash {
+	if c.hasher == nil {
+		c.hasher = hashers[DefaultHasher]
+	}
+	if c.key == nil {
+		return c.hasher.New()
+	}
+	return hmac.New(c.hasher.New, c.key)
+}
+
+// scannedHash returns the hash of the current record of a scanner,
+// applying any regex and replacement if defined.
+func (c *Checksummer) scannedHash(s recordScanner) (h [sha256.Size]byte, err error) {
+	if lr, ok := s.(*lineReader); ok && lr.cur.digest != nil {
+		lr.cur.digest.Sum(h[:0])
+		return h, nil
+	}
+	record, err := c.normalize(s.Bytes())
+	if err != nil {
+		return h, err
+	}
+	return c.hashRecord(record), nil
+}
+
+// Records returns the number of records checksummed or verified so far.
+func (c *Checksummer) Records() uint64 {
+	return c.nrecs
+}
+
+// Reset clears the checksum so that the Checksummer can be reused, and
+// keeps its options (hash algorithm, key, mask, verbose output and
+// progress reporting).
+func (c *Checksummer) Reset() {
+	c.sum = [sha256.Size]byte{}
+	c.recHashes = nil
+	c.nrecs = 0
+	c.partial = false
+	c.wbuf, c.wr = nil, nil
+	c.props = nil
+	c.nbytes = 0
+	c.start = time.Time{}
+	c.elapsed = 0
+	c.nextRecs, c.nextBytes = c.pRecs, c.pBytes
+}
+
+// Write adds newline-terminated records to the checksum, so that a
+// Checksummer can be used as an io.Writer (e.g. in an io.MultiWriter).
+// Records may be split across calls to Write, and are read in the same
+// way as by Sum. An unterminated final record is added by Flush. AppendSum
+// and Info include it without adding it, so that Write can continue it.
+func (c *Checksummer) Write(p []byte) (int, error) {
+	c.startWrite()
+	if c.wr == nil {
+		c.wbuf = &writeBuffer{}
+		c.wr = c.newScanner(c.wbuf)
+	}
+	c.wbuf.Write(p)
+	if c.wr.lines == 0 && !c.wr.cur.partial && c.wbuf.Len() < len(utf8BOM) {
+		// wait until a byte order mark can be detected
+		return len(p), nil
+	}
+	err := c.sumRecords(context.Background(), c.wr)
+	c.wbuf.trim(c.wr)
+	return len(p), err
+}
+
+// AddRecord adds a single record, without a line terminator, to the
+// checksum, applying any regex and replacement if defined. Returns a
+// RecordError if the record is not valid in the record format.
+func (c *Checksummer) AddRecord(record []byte) error {
+	c.startWrite()
+	normal, err := c.normalize(record)
+	if err != nil {
+		return &RecordError{Line: c.nrecs + 1, Err: err}
+	}
+	c.addRecord(normal)
+	c.scanned(len(record))
+	return nil
+}
+
+// startWrite prepares for records added by Write or AddRecord.
+func (c *Checksummer) startWrite() {
+	if c.recHashes == nil {
+		c.recHashes = newQuickSum(DefaultSumSize)
+	}
+	c.begin()
+}
+
+// Flush adds any unterminated final record passed to Write, and ends
+// the progress reporting for records added by Write or AddRecord. Later
+// calls to Write start a new data stream.
+func (c *Checksummer) Flush() error {
+	var err error
+	if c.wr != nil {
+		c.wbuf.closed = true
+		err = c.sumRecords(context.Background(), c.wr)
+		c.props = &c.wr.props
+		c.wbuf, c.wr = nil, nil
+	}
+	if !c.start.IsZero() {
+		c.end()
+	}
+	return err
+}
+
+// AppendSum appends the content hash to b, in the manner of hash.Hash's
+// Sum. Like Sum, it does not change the state of the Checksummer: an
+// unterminated record passed to Write is included, but not added.
+func (c *Checksummer) AppendSum(b []byte) []byte {
+	p, release := c.pending(false)
+	defer release()
+	return append(b, p.sum[:]...)
+}
+
+// Hash returns a hash.Hash which passes data to the Checksummer's Write,
+// and whose Sum is AppendSum, so that a Checksummer can be used where a
+// hash.Hash is expected. Its Reset calls Reset.
+func (c *Checksummer) Hash() hash.Hash {
+	return checksumHash{c}
+}
+
+// checksumHash adapts a Checksummer to hash.Hash, see Checksummer.Hash.
+type checksumHash struct {
+	c *Checksummer
+}
+
+var _ hash.Hash = checksumHash{}
+
+func (h checksumHash) Write(p []byte) (int, error) { return h.c.Write(p) }
+func (h checksumHash) Sum(b []byte) []byte         { return h.c.AppendSum(b) }
+func (h checksumHash) Reset()                      { h.c.Reset() }
+func (h checksumHash) Size() int                   { return sha256.Size }
+
+// BlockSize is 1, as records may be written in any number of bytes.
+func (h checksumHash) BlockSize() int { return 1 }
+
+// pending returns the Checksummer, or if records are being passed to
+// Write, a copy of it to which any unterminated record has been added as
+// if by Flush. If withRecords is set, the record is also added to the
+// records_hash, which is shared with the copy rather than cloned, until
+// the returned release function is called.
+func (c *Checksummer) pending(withRecords bool) (*Checksummer, func()) {
+	if c.wr == nil {
+		return c, func() {}
+	}
+	p := *c
+	p.progress, p.vout, p.unverified = nil, nil, nil
+	p.recHashes = newQuickSum(DisableQuickSums)
+	release := func() {}
+	if withRecords && c.recHashes != nil {
+		us := &undoSum{quickSum: c.recHashes}
+		p.recHashes, release = us, us.release
+	}
+
+	// read the unterminated record again, after any blank lines which
+	// were held back in CanonicalLines mode
+	p.wbuf = &writeBuffer{closed: true}
+	p.wbuf.Buffer.Write(c.wbuf.tail)
+	p.wr = c.newScanner(p.wbuf)
+	p.wr.lines, p.wr.props = c.wr.lines, c.wr.props
+	p.wr.blanks = append([]int(nil), c.wr.blanks...)
+	p.sumRecords(context.Background(), p.wr)
+	p.props = &p.wr.props
+	p.wbuf, p.wr = nil, nil
+	return &p, release
+}
+
+// Partial returns true if a scan was cancelled part-way through, in which
+// case the checksum only includes the records read before it stopped.
+func (c *Checksummer) Partial() bool {
+	return c.partial
+}
+
 // Sum lines read from the provided io.Reader until EOF if hit.
 func (c *Checksummer) Sum(r io.Reader) error {
-	s := bufio.NewScanner(r)
-	s.Buffer(make([]byte, maxLineLength), maxLineLength)
-	return c.SumScanner(s)
+	return c.sumScanner(context.Background(), c.newScanner(r))
+}
+
+// SumContext is like Sum, but stops reading if the context is done. The
+// context is checked between records, and if it is done the Checksummer
+// is marked Partial (see Info) and ctx.Err() is returned.
+func (c *Checksummer) SumContext(ctx context.Context, r io.Reader) error {
+	return c.sumScanner(ctx, c.newScanner(r))
 }
 
 // SumScanner scans records from the Scanner, applying any regex and
 // replacement if defined, and adding the content to the checksum.
+// Unless the Scanner was created by Sum, each record is counted as one
+// byte longer than its content for progress reporting.
 func (c *Checksummer) SumScanner(s *bufio.Scanner) error {
+	return c.sumScanner(context.Background(), s)
+}
+
+func (c *Checksummer) sumScanner(ctx context.Context, s recordScanner) error {
 	if c.recHashes == nil {
 		c.recHashes = newQuickSum(DefaultSumSize)
 	}
 
+	c.begin()
+	defer c.end()
+	err := c.sumRecords(ctx, s)
+	if lr, ok := s.(*lineReader); ok {
+		c.props = &lr.props
+	}
+	return err
+}
+
+// sumRecords adds the records of a scanner to the checksum.
+func (c *Checksummer) sumRecords(ctx context.Context, s recordScanner) error {
+	done := ctx.Done()
 	for s.Scan() {
-		c.sumBytes(s.Bytes())
+		if isDone(done) {
+			c.partial = true
+			return ctx.Err()
+		}
+		nh, err := c.scannedHash(s)
+		if err != nil {
+			line := recordLine(s)
+			if line == 0 {
+				line = c.nrecs + 1
+			}
+			return &RecordError{Line: line, Err: err}
+		}
+		c.addHash(nh)
+		c.scanned(recordBytes(s))
 	}
 	return s.Err()
 }
 
-func (c *Checksummer) sumBytes(record []byte) {
+// isDone returns true if a context's Done channel is closed.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// mask applies any regex and replacement to the record.
+func (c *Checksummer) mask(record []byte) []byte {
 	if c.replacer != nil {
-		record = c.replacer.ReplaceAllLiteral([]byte(record), c.replacement)
+		record = c.replacer.ReplaceAllLiteral(record, c.replacement)
 	}
+	return record
+}
 
-	nh := sha256.Sum256(record)
+// normalize converts a record to the form which is hashed, in the
+// record format and with any regex and replacement applied.
+func (c *Checksummer) normalize(record []byte) ([]byte, error) {
+	record, err := c.parseRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	return c.mask(record), nil
+}
+
+// parseRecord converts a record to its canonical form in the record
+// format (JSON or a fixed-width layout), before any mask is applied.
+func (c *Checksummer) parseRecord(record []byte) ([]byte, error) {
+	switch {
+	case c.json != nil:
+		return c.json.canonical(record)
+	case c.layout != nil:
+		return c.layout.project(record), nil
+	}
+	return record, nil
+}
+
+// addRecord adds an already-masked record to the checksum.
+func (c *Checksummer) addRecord(record []byte) {
+	c.addHash(c.hashRecord(record))
+}
+
+// addHash adds the hash of a record to the checksum.
+func (c *Checksummer) addHash(nh [sha256.Size]byte) {
 	c.nrecs++
 	c.recHashes.Add(nh[:])
 	xorBytes(c.sum[:], c.sum[:], nh[:])
@@ -81,54 +634,172 @@ func (c *Checksummer) sumBytes(record []byte) {
 
 // Verify lines read from the provided io.Reader until EOF if hit.
 func (c *Checksummer) Verify(r io.Reader, verify map[string]string) (bool, int, error) {
-	s := bufio.NewScanner(r)
-	s.Buffer(make([]byte, maxLineLength), maxLineLength)
-	return c.VerifyScanner(s, verify)
+	return c.verifyScanner(context.Background(), c.newScanner(r), verify)
+}
+
+// VerifyContext is like Verify, but stops reading if the context is done.
+// The context is checked between records, and if it is done the
+// Checksummer is marked Partial and ctx.Err() is returned along with the
+// number of unverified records found so far.
+func (c *Checksummer) VerifyContext(ctx context.Context, r io.Reader, verify map[string]string) (bool, int, error) {
+	return c.verifyScanner(ctx, c.newScanner(r), verify)
 }
 
 // VerifyScanner scans records from the Scanner, applying any regex and
 // replacement if defined, and verifying the content to the checksum.
+// Returns true if the content hash matched, and otherwise the number of
+// records which were not found in the records_hash.
 func (c *Checksummer) VerifyScanner(s *bufio.Scanner, verify map[string]string) (bool, int, error) {
-	err := c.unpackRecs(verify["records_hash"])
+	return c.verifyScanner(context.Background(), s, verify)
+}
+
+func (c *Checksummer) verifyScanner(ctx context.Context, s recordScanner, verify map[string]string) (bool, int, error) {
+	err := c.setupVerify(verify)
 	if err != nil {
-		return false, -1, err
+		return false, -1, &ManifestError{Err: err}
 	}
-
-	if rx, ok := verify["mask_regex"]; ok && rx != "" {
-		c.SetRegex(rx, verify["mask_replacement"])
+	lr, _ := s.(*lineReader)
+	if lr != nil {
+		// the lineReader was created before the options were known
+		c.setupScanner(lr)
 	}
 
-	nlines := 0
+	var nlines uint64
+	offset := c.nbytes
 	noverify := 0
+	c.begin()
+	done := ctx.Done()
 	for s.Scan() {
+		if isDone(done) {
+			c.partial = true
+			c.end()
+			return false, noverify, ctx.Err()
+		}
 		nlines++
-		if !c.verifyBytes(s.Bytes()) {
+		if lr != nil {
+			nlines = lr.cur.line
+		}
+		nh, rerr := c.scannedHash(s)
+		if rerr != nil {
+			// it can't have been in the checksummed data
+			nh = c.hashRecord(s.Bytes())
+		}
+		if !c.verifyHash(nh) || rerr != nil {
 			noverify++
-			if c.vout != nil {
-				fmt.Fprintf(c.vout, "UNVERIFIED: %5d: %s\n", nlines, s.Text())
-			}
+			c.reportUnverified(UnverifiedRecord{
+				Line:   nlines,
+				Offset: c.nbytes - offset,
+				Length: recordLength(s),
+				Hash:   nh,
+				Record:     s.Bytes(),
+				Terminated: recordTerminated(s),
+				Err:        rerr,
+			})
 		}
+		c.scanned(recordBytes(s))
+	}
+	c.end()
+	if lr != nil {
+		c.props = &lr.props
 	}
 
 	// check final content hash
 	valid := verify["content_hash"] == fmt.Sprintf("%064x", c.sum)
 	if valid {
-		fmt.Fprintln(os.Stderr, "CHECKSUM OK")
 		noverify = 0
-	} else {
-		fmt.Fprintln(os.Stderr, "CHECKSUM FAILED")
-		fmt.Fprintf(os.Stderr, "%d/%d records failed verification\n", noverify, c.nrecs)
 	}
-
 	return valid, noverify, s.Err()
 }
 
-func (c *Checksummer) verifyBytes(record []byte) bool {
-	if c.replacer != nil {
-		record = c.replacer.ReplaceAllLiteral([]byte(record), c.replacement)
+// reportUnverified prints an unverified record if verbose output is
+// enabled, and passes it to the SetUnverified callback.
+func (c *Checksummer) reportUnverified(u UnverifiedRecord) {
+	if c.vout != nil {
+		if u.Err != nil {
+			fmt.Fprintf(c.vout, "UNVERIFIED: %5d (offset %d): %s: %s\n", u.Line, u.Offset, u.Err.Error(),
+				bytes.TrimRight(u.Record, "\r\n"))
+		} else if u.Record != nil {
+			fmt.Fprintf(c.vout, "UNVERIFIED: %5d (offset %d): %s\n", u.Line, u.Offset, bytes.TrimRight(u.Record, "\r\n"))
+		} else {
+			fmt.Fprintf(c.vout, "UNVERIFIED: %5d (offset %d): %d byte record not shown\n", u.Line, u.Offset, u.Length)
+		}
+	}
+	if c.unverified != nil {
+		c.unverified(u)
+	}
+}
+
+// setupVerify configures the Checksummer to use the same record hashing
+// options as the provided verification data, and loads its records_hash.
+func (c *Checksummer) setupVerify(verify map[string]string) error {
+	if kid := verify["key_id"]; kid != c.keyID {
+		if c.keyID == "" {
+			return fmt.Errorf("verification data requires key %s", kid)
+		}
+		if kid == "" {
+			return fmt.Errorf("verification data was not created with a key")
+		}
+		return fmt.Errorf("key %s does not match verification data key %s", c.keyID, kid)
+	}
+	if len(verify["content_hash"]) != 64 {
+		return fmt.Errorf("verification data has no valid content_hash")
+	}
+	if verify["partial"] == "true" {
+		return fmt.Errorf("verification data is from a scan which was cancelled part-way through")
+	}
+
+	err := c.SetHasher(verify["hash_algorithm"])
+	if err != nil {
+		return err
+	}
+
+	err = c.unpackRecs(verify["records_hash"])
+	if err != nil {
+		return err
 	}
+	return c.setupFormat(verify)
+}
 
-	nh := sha256.Sum256(record)
+// setupFormat configures the Checksummer to split, parse and mask
+// records in the same way as the provided checksum information.
+func (c *Checksummer) setupFormat(info map[string]string) error {
+	err := c.SetLineMode(LineMode(info["line_mode"]))
+	if err != nil {
+		return err
+	}
+	if c.maxRecord == 0 {
+		if c.maxRecord, err = parseRecordLimit(info["max_record_length"]); err != nil {
+			return err
+		}
+	}
+	// clear the record format first, as JSON and layouts can't be mixed
+	c.json, c.layout = nil, nil
+	jopts, err := jsonOptionsFromInfo(info)
+	if err == nil {
+		err = c.SetJSON(jopts)
+	}
+	if err != nil {
+		return err
+	}
+	layout, err := layoutFromInfo(info)
+	if err == nil {
+		err = c.SetLayout(layout)
+	}
+	if err != nil {
+		return err
+	}
+
+	// replace any mask, including with none
+	c.replacer, c.replacement = nil, nil
+	if rx, ok := info["mask_regex"]; ok && rx != "" {
+		return c.SetRegex(rx, info["mask_replacement"])
+	}
+	return nil
+}
+
+// verifyHash adds the hash of a record to the checksum, and returns
+// true if it is in the records_hash.
+func (c *Checksummer) verifyHash(nh [sha256.Size]byte) bool {
 	c.nrecs++
 	b := c.recHashes.Has(nh[:])
 	xorBytes(c.sum[:], c.sum[:], nh[:])
@@ -147,12 +818,39 @@ func (c *Checksummer) verifyBytes(record []byte) bool {
 //    "records_esterr": an estimated error rate for the record verifier
 //    "mask_regex": regular rexpression used to identify and mask non-normative values
 //    "mask_replacement": replacement text to use for masked values
+//    "hash_algorithm": name of the algorithm used to hash each record
+//    "key_id": identifier of the secret used for keyed (HMAC) record hashing
+//    "bytes_read": total (decompressed) bytes of data read, including line terminators
+//    "elapsed_seconds": time spent summing or verifying the data
+//    "partial": "true" if a scan was cancelled, so not all the data was checksummed
+//    "line_mode": how the data was split into records, if not DefaultLines
+//    "max_record_length": longest record in bytes that was accepted, 0 for no limit
+//    "input_bom": "true" if the data started with a UTF-8 byte order mark
+//    "input_line_endings": line terminators found in the data: "lf", "crlf", "mixed" or "none"
+//    "input_final_newline": "false" if the last line of the data was not terminated
+//    "input_trailing_blank_lines": number of empty lines at the end of the data
+//    "record_format": "json" if each record is checksummed as canonical JSON, "fixed" for a fixed-width layout
+//    "json_include", "json_exclude": JSON arrays of the JSON pointers selecting the checksummed values
+//    "record_layout": the Layout of fixed-width records, as JSON
 //
 func (c *Checksummer) Info() map[string]string {
+	c, release := c.pending(true)
+	defer release()
+	if c.recHashes == nil {
+		c.recHashes = newQuickSum(DefaultSumSize)
+	}
 	r := map[string]string{
 		"when_checked":  time.Now().UTC().Format(time.RFC3339),
 		"content_hash":  fmt.Sprintf("%064x", c.sum),
 		"total_records": fmt.Sprint(c.nrecs),
+		"bytes_read":    fmt.Sprint(c.nbytes),
+	}
+	p := c.Progress()
+	r["elapsed_seconds"] = fmt.Sprintf("%.3f", p.Elapsed.Seconds())
+	if c.hasher != nil {
+		r["hash_algorithm"] = c.hasher.Name()
+	} else {
+		r["hash_algorithm"] = DefaultHasher
 	}
 	if c.recHashes.Type() != DisableQuickSums {
 		nkeys := float64(c.recHashes.Keys())
@@ -166,6 +864,30 @@ func (c *Checksummer) Info() map[string]string {
 		r["mask_regex"] = c.replacer.String()
 		r["mask_replacement"] = string(c.replacement)
 	}
+	if c.keyID != "" {
+		r["key_id"] = c.keyID
+	}
+	if c.partial {
+		r["partial"] = "true"
+	}
+	if c.lineMode != DefaultLines {
+		r["line_mode"] = string(c.lineMode)
+	}
+	if c.maxRecord != 0 {
+		r["max_record_length"] = formatRecordLimit(c.maxRecord)
+	}
+	if c.json != nil {
+		c.json.info(r)
+	}
+	if c.layout != nil {
+		c.layout.info(r)
+	}
+	if c.props != nil && (c.layout == nil || c.layout.layout.RecordLength == 0) {
+		r["input_bom"] = fmt.Sprint(c.props.BOM)
+		r["input_line_endings"] = c.props.LineEndings()
+		r["input_final_newline"] = fmt.Sprint(c.props.FinalNewline)
+		r["input_trailing_blank_lines"] = fmt.Sprint(c.props.TrailingBlankLines)
+	}
 	return r
 }
 
@@ -191,15 +913,79 @@ func (c *Checksummer) unpackRecs(x string) error {
 		c.recHashes = newQuickSum(DisableQuickSums)
 		return nil
 	}
-	xb, err := base64.StdEncoding.DecodeString(x)
+	qs, err := decodeRecs(x)
 	if err != nil {
 		return err
 	}
-	zb := bytes.NewBuffer(xb)
-	z, _ := gzip.NewReader(zb)
-	rhb, _ := ioutil.ReadAll(z)
-	z.Close()
-	c.recHashes = newQuickSum(QuickSumSize(rhb[0]))
-	c.recHashes.Import(rhb[1:])
+	c.recHashes = qs
 	return nil
 }
+
+// decodeRecs decodes a packed records_hash.
+func decodeRecs(x string) (quickSum, error) {
+	xb, err := base64.StdEncoding.DecodeString(x)
+	if err != nil {
+		return nil, fmt.Errorf("invalid records_hash: %s", err.Error())
+	}
+	z, err := gzip.NewReader(bytes.NewReader(xb))
+	if err != nil {
+		return nil, fmt.Errorf("invalid records_hash: %s", err.Error())
+	}
+	rhb, err := ioutil.ReadAll(z)
+	z.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid records_hash: %s", err.Error())
+	}
+	if len(rhb) == 0 {
+		return nil, fmt.Errorf("invalid records_hash: no data")
+	}
+	switch QuickSumSize(rhb[0]) {
+	case SmallSumSize, MediumSumSize, LargeSumSize, DisableQuickSums:
+	default:
+		return nil, fmt.Errorf("invalid records_hash: unknown filter type %q", rhb[0])
+	}
+	qs := newQuickSum(QuickSumSize(rhb[0]))
+	if err = qs.Import(rhb[1:]); err != nil {
+		return nil, fmt.Errorf("invalid records_hash: %s", err.Error())
+	}
+	return qs, nil
+}
+
+// RecordsHashInfo describes the Bloom filter stored in a records_hash.
+type RecordsHashInfo struct {
+	// Size is the filter's size classification.
+	Size QuickSumSize `json:"size"`
+	// Keys is the number of bits set for each record.
+	Keys int `json:"keys"`
+	// Bits is the size of the filter in bits.
+	Bits int `json:"bits"`
+	// SetBits is the number of bits set in the filter.
+	SetBits int `json:"set_bits"`
+}
+
+// FillRatio returns the fraction of the filter's bits which are set. As
+// it approaches 1, more records which were not checksummed will be
+// falsely reported as verified.
+func (r *RecordsHashInfo) FillRatio() float64 {
+	if r.Bits == 0 {
+		return 0
+	}
+	return float64(r.SetBits) / float64(r.Bits)
+}
+
+// InspectRecordsHash decodes the records_hash from a Checksummer's Info().
+func InspectRecordsHash(x string) (*RecordsHashInfo, error) {
+	qs, err := decodeRecs(x)
+	if err != nil {
+		return nil, err
+	}
+	b, err := qs.Export()
+	if err != nil {
+		return nil, err
+	}
+	r := &RecordsHashInfo{Size: qs.Type(), Keys: qs.Keys(), Bits: qs.Bits()}
+	for _, v := range b {
+		r.SetBits += bits.OnesCount8(v)
+	}
+	return r, nil
+}
@@ -0,0 +1,163 @@
+package qcd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"testing"
+)
+
+func sumOf(t *testing.T, mode LineMode, data string) []byte {
+	t.Helper()
+	c := &Checksummer{}
+	c.SetLineMode(mode)
+	if err := c.Sum(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	return c.AppendSum(nil)
+}
+
+func infoOf(t *testing.T, mode LineMode, data string) map[string]string {
+	t.Helper()
+	c := &Checksummer{}
+	c.SetLineMode(mode)
+	if err := c.Sum(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	return c.Info()
+}
+
+func TestAppendSumBetweenWrites(t *testing.T) {
+	cases := []struct {
+		mode          LineMode
+		first, second string
+	}{
+		{DefaultLines, "ab", "c\n"},
+		{DefaultLines, "a\nb\r", "\nc"},
+		{ExactLines, "a\r", "\n"},
+		{CanonicalLines, "\xef\xbb", "\xbfa\r\n"},
+		{CanonicalLines, "a\n\n", "b\n\n"},
+	}
+	for _, tc := range cases {
+		c := &Checksummer{}
+		c.SetLineMode(tc.mode)
+		c.Write([]byte(tc.first))
+		mid := c.AppendSum(nil)
+		if want := sumOf(t, tc.mode, tc.first); !bytes.Equal(mid, want) {
+			t.Errorf("%q %q: AppendSum after the first Write = %x, want %x", tc.mode, tc.first, mid, want)
+		}
+		info := c.Info()
+		if info["content_hash"] != fmt.Sprintf("%x", mid) {
+			t.Errorf("%q %q: Info content_hash = %s, want %x", tc.mode, tc.first, info["content_hash"], mid)
+		}
+		if want := infoOf(t, tc.mode, tc.first); info["records_hash"] != want["records_hash"] {
+			t.Errorf("%q %q: Info records_hash differs from summing the data", tc.mode, tc.first)
+		}
+
+		c.Write([]byte(tc.second))
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		whole := tc.first + tc.second
+		if got, want := c.AppendSum(nil), sumOf(t, tc.mode, whole); !bytes.Equal(got, want) {
+			t.Errorf("%q %q: sum after AppendSum = %x, want %x", tc.mode, whole, got, want)
+		}
+		ref := &Checksummer{}
+		ref.SetLineMode(tc.mode)
+		ref.Sum(strings.NewReader(whole))
+		if c.Records() != ref.Records() {
+			t.Errorf("%q %q: %d records, want %d", tc.mode, whole, c.Records(), ref.Records())
+		}
+		if c.Info()["records_hash"] != ref.Info()["records_hash"] {
+			t.Errorf("%q %q: records_hash after Info differs from summing the data", tc.mode, whole)
+		}
+	}
+}
+
+func TestQuickSumAddUndo(t *testing.T) {
+	for _, size := range []QuickSumSize{SmallSumSize, MediumSumSize} {
+		qs := newQuickSum(size)
+		for i := 0; i < 100; i++ {
+			h := sha256.Sum256([]byte(fmt.Sprint(i)))
+			qs.Add(h[:])
+		}
+		before, _ := qs.Export()
+
+		us := &undoSum{quickSum: qs}
+		for i := 100; i < 110; i++ {
+			h := sha256.Sum256([]byte(fmt.Sprint(i)))
+			us.Add(h[:])
+			if !qs.Has(h[:]) {
+				t.Fatalf("%c: value was not added", size)
+			}
+		}
+		us.release()
+		if after, _ := qs.Export(); !bytes.Equal(before, after) {
+			t.Errorf("%c: quickSum changed after release", size)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	c := &Checksummer{}
+	var h hash.Hash = c.Hash()
+	if h.Size() != len(sumOf(t, DefaultLines, "")) {
+		t.Errorf("Size = %d, want the length of Sum", h.Size())
+	}
+	io.WriteString(h, "a\nb")
+	if got, want := h.Sum(nil), sumOf(t, DefaultLines, "a\nb"); !bytes.Equal(got, want) {
+		t.Errorf("Sum = %x, want %x", got, want)
+	}
+	io.WriteString(h, "c\n")
+	if got, want := h.Sum([]byte("x")), append([]byte("x"), sumOf(t, DefaultLines, "a\nbc\n")...); !bytes.Equal(got, want) {
+		t.Errorf("Sum = %x, want %x", got, want)
+	}
+	h.Reset()
+	if got, want := h.Sum(nil), sumOf(t, DefaultLines, ""); !bytes.Equal(got, want) {
+		t.Errorf("Sum after Reset = %x, want %x", got, want)
+	}
+}
+
+func TestUnverifiedTerminated(t *testing.T) {
+	fixed := func(ck *Checksummer) {
+		ck.SetLayout(&Layout{RecordLength: 3, Fields: []LayoutField{{Name: "v", Offset: 0, Length: 3}}})
+	}
+	cases := []struct {
+		name         string
+		setup        func(*Checksummer)
+		base, target string
+		want         string
+	}{
+		{"default", func(*Checksummer) {}, "a\nb\n", "a\nx\r\ny", "x\ny"},
+		{"exact", func(ck *Checksummer) { ck.SetLineMode(ExactLines) }, "a\n", "a\nx\r\ny", "x\r\ny"},
+		{"canonical", func(ck *Checksummer) { ck.SetLineMode(CanonicalLines) }, "a\n", "\n\na\nx", "\n\nx"},
+		{"fixed", fixed, "aaa", "aaax\ny\nzz", "x\ny\nzz"},
+	}
+	for _, tc := range cases {
+		ck := &Checksummer{}
+		tc.setup(ck)
+		if err := ck.Sum(strings.NewReader(tc.base)); err != nil {
+			t.Fatal(err)
+		}
+		info := ck.Info()
+
+		ck = &Checksummer{}
+		tc.setup(ck)
+		var got bytes.Buffer
+		ck.SetUnverified(func(u UnverifiedRecord) {
+			got.Write(u.Record)
+			if u.Terminated {
+				got.WriteByte('\n')
+			}
+		})
+		if _, _, err := ck.Verify(strings.NewReader(tc.target), info); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got.String() != tc.want {
+			t.Errorf("%s: unverified records = %q, want %q", tc.name, got.String(), tc.want)
+		}
+	}
+}
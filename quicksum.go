@@ -3,6 +3,7 @@ package qcd
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math"
 )
 
@@ -51,6 +52,29 @@ type quickSum interface {
 	Add([]byte)
 	// always 32 bytes
 	Has([]byte) bool
+
+	// addUndo is like Add, but returns a function which restores the
+	// quickSum to its state before the value was added
+	addUndo([]byte) func()
+}
+
+// undoSum adds values to a quickSum so that they can all be removed
+// again, see Checksummer.pending.
+type undoSum struct {
+	quickSum
+	undo []func()
+}
+
+func (s *undoSum) Add(v []byte) {
+	s.undo = append(s.undo, s.quickSum.addUndo(v))
+}
+
+// release removes the values which were added.
+func (s *undoSum) release() {
+	for i := len(s.undo) - 1; i >= 0; i-- {
+		s.undo[i]()
+	}
+	s.undo = nil
 }
 
 /////////
@@ -152,6 +176,19 @@ func (m *qcMeta) Has(v []byte) bool {
 	panic("can't has a qcMeta!")
 }
 
+func (m *qcMeta) addUndo(v []byte) func() {
+	nadds, best := m.nadds, m.best
+	u16, u24, u32 := m.x16.addUndo(v), m.x24.addUndo(v), m.x32.addUndo(v)
+	m.nadds++
+	m.best = nil
+	return func() {
+		u32()
+		u24()
+		u16()
+		m.nadds, m.best = nadds, best
+	}
+}
+
 /////////
 
 // a 8 KByte bloom filter
@@ -178,6 +215,9 @@ func (x *qc16) Reset() {
 }
 
 func (x *qc16) Import(v []byte) error {
+	if len(v) != len(x)*2 {
+		return fmt.Errorf("expected %d bytes, got %d", len(x)*2, len(v))
+	}
 	for i := 0; i < len(v); i += 2 {
 		(*x)[i>>1] = uint16(v[i+1])<<8 | uint16(v[i])
 	}
@@ -207,6 +247,22 @@ func (x *qc16) Add(v []byte) {
 	}
 }
 
+func (x *qc16) addUndo(v []byte) func() {
+	var idxs []uint32
+	var saved []uint16
+	for i := 0; i < len(v)-2; i += 2 {
+		idx := (uint32(v[i])<<8 | uint32(v[i+1])) >> 4
+		idxs, saved = append(idxs, idx), append(saved, (*x)[idx])
+	}
+	x.Add(v)
+	return func() {
+		// restore in reverse, in case a word was changed twice
+		for i := len(idxs) - 1; i >= 0; i-- {
+			(*x)[idxs[i]] = saved[i]
+		}
+	}
+}
+
 func (x qc16) Has(v []byte) bool {
 	for i := 0; i < len(v)-2; i += 2 {
 		idx := uint32(v[i])<<8 | uint32(v[i+1])
@@ -266,6 +322,21 @@ func (x *qc24) Add(v []byte) {
 	}
 }
 
+func (x *qc24) addUndo(v []byte) func() {
+	var idxs []uint32
+	var saved []uint16
+	for i := 0; i < len(v)-3; i += 3 {
+		idx := (uint32(v[i])<<16 | uint32(v[i+1])<<8 | uint32(v[i+2])) >> 4
+		idxs, saved = append(idxs, idx), append(saved, (*x)[idx])
+	}
+	x.Add(v)
+	return func() {
+		for i := len(idxs) - 1; i >= 0; i-- {
+			(*x)[idxs[i]] = saved[i]
+		}
+	}
+}
+
 func (x *qc24) Has(v []byte) bool {
 	for i := 0; i < len(v)-3; i += 3 {
 		idx := uint32(v[i])<<16 | uint32(v[i+1])<<8 | uint32(v[i+2])
@@ -332,6 +403,23 @@ func (x *qc32) Add(v []byte) {
 	}
 }
 
+func (x *qc32) addUndo(v []byte) func() {
+	if len(*x) == 0 {
+		*x = make([]uint32, 1<<27)
+	}
+	var idxs, saved []uint32
+	for i := 0; i < len(v)-4; i += 4 {
+		idx := ((uint32(v[i]) << 24) | (uint32(v[i+1]) << 16) | (uint32(v[i+2]) << 8) | (uint32(v[i+3]))) >> 5
+		idxs, saved = append(idxs, idx), append(saved, (*x)[idx])
+	}
+	x.Add(v)
+	return func() {
+		for i := len(idxs) - 1; i >= 0; i-- {
+			(*x)[idxs[i]] = saved[i]
+		}
+	}
+}
+
 func (x *qc32) Has(v []byte) bool {
 	for i := 0; i < len(v)-4; i += 4 {
 		idx := (uint32(v[i]) << 24) | (uint32(v[i+1]) << 16) | (uint32(v[i+2]) << 8) | (uint32(v[i+3]))
@@ -373,3 +461,6 @@ func (dqs) Add([]byte) {
 func (dqs) Has([]byte) bool {
 	return true
 }
+func (dqs) addUndo([]byte) func() {
+	return func() {}
+}
@@ -1,18 +1,12 @@
 package qcd
 
 import (
-	"bufio"
-	"compress/bzip2"
-	"compress/gzip"
-	"crypto/sha256"
-	"encoding/json"
+	"context"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
 	"os"
-	"strings"
-
-	"github.com/ulikunitz/xz"
+	"regexp"
 )
 
 // Source is a data source which has associated QCD checksum information.
@@ -23,225 +17,538 @@ type Source struct {
 	// CheckFilename contains the QCD checksummer infomation.
 	CheckFilename string
 
-	ck *Checksummer
+	ck    *Checksummer
+	vdata map[string]string
+
+	// options
+	key            []byte
+	hasher         string
+	lineMode       LineMode
+	maxRecord      int
+	json           *JSONOptions
+	layout         *Layout
+	maskRegex      string
+	maskReplace    string
+	forceMask      bool
+	computeMissing bool
+
+	// mask applied to lines, which may differ from the checksum's mask
+	lineMask *regexp.Regexp
+	lineRepl []byte
 
 	lines []string
+	// unmasked records, only kept if a mask or a record format is used
+	raw []string
+}
+
+// SourceOption configures how a Source is opened and verified.
+type SourceOption func(*Source)
+
+// WithKey sets the secret used for keyed (HMAC) record hashing. It is
+// required when the source's verification data was created with a key.
+func WithKey(key []byte) SourceOption {
+	return func(s *Source) {
+		s.key = key
+	}
+}
+
+// WithoutCheckFile allows a Source to be created for data without a
+// QCD checksum file, in which case the checksum information is computed
+// while the data is read.
+func WithoutCheckFile() SourceOption {
+	return func(s *Source) {
+		s.computeMissing = true
+	}
+}
+
+// WithMask sets the regex and replacement used to mask records when
+// the checksum information is computed on the fly.
+func WithMask(regex, replacement string) SourceOption {
+	return func(s *Source) {
+		s.maskRegex = regex
+		s.maskReplace = replacement
+	}
+}
+
+// WithCommonMask sets the regex and replacement used to mask records for
+// comparison, overriding the mask in the QCD checksum file (which is
+// still used to verify the data). Use the same common mask on sources
+// which were masked differently so that they can be compared.
+func WithCommonMask(regex, replacement string) SourceOption {
+	return func(s *Source) {
+		s.maskRegex = regex
+		s.maskReplace = replacement
+		s.forceMask = true
+	}
+}
+
+// WithHasher sets the record hash algorithm used when the checksum
+// information is computed on the fly.
+func WithHasher(name string) SourceOption {
+	return func(s *Source) {
+		s.hasher = name
+	}
+}
+
+// WithLineMode sets how records are split into lines when the checksum
+// information is computed on the fly.
+func WithLineMode(mode LineMode) SourceOption {
+	return func(s *Source) {
+		s.lineMode = mode
+	}
+}
+
+// WithMaxRecordLength sets the longest record which is read, see
+// Checksummer.SetMaxRecordLength. Zero uses the limit stored in the QCD
+// checksum file, or DefaultMaxRecordLength.
+func WithMaxRecordLength(n int) SourceOption {
+	return func(s *Source) {
+		s.maxRecord = n
+	}
+}
+
+// WithJSON sets the JSON record format options used when the checksum
+// information is computed on the fly.
+func WithJSON(opts *JSONOptions) SourceOption {
+	return func(s *Source) {
+		s.json = opts
+	}
+}
+
+// WithLayout sets the fixed-width record layout used when the checksum
+// information is computed on the fly.
+func WithLayout(l *Layout) SourceOption {
+	return func(s *Source) {
+		s.layout = l
+	}
 }
 
 // NewSource creates a new QCD-verified data source.
-func NewSource(filename string) (*Source, error) {
-	checkfilename := filename
-	f, err := os.Open(filename)
+func NewSource(filename string, opts ...SourceOption) (*Source, error) {
+	return NewSourceContext(context.Background(), filename, opts...)
+}
+
+// NewSourceContext is like NewSource, but stops reading the data and
+// returns ctx.Err() if the context is done.
+func NewSourceContext(ctx context.Context, filename string, opts ...SourceOption) (*Source, error) {
+	s := &Source{Filename: filename}
+	for _, o := range opts {
+		o(s)
+	}
+
+	in, err := OpenInput(filename)
 	if err != nil {
 		return nil, err
 	}
-	var src io.Reader = f
+	defer in.Close()
 
-	if strings.HasSuffix(filename, ".gz") {
-		zr, err := gzip.NewReader(f)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "WARNING: filename looks like gzip but failed to open: %s\n", err.Error())
-		} else {
-			src = zr
+	if filename == Stdin {
+		// standard input can only be read once, so it can't be verified
+		if !s.computeMissing {
+			return nil, fmt.Errorf("no QCD checksum file for standard input")
 		}
-		checkfilename = strings.TrimSuffix(filename, ".gz")
-	}
-	if strings.HasSuffix(filename, ".bz2") {
-		// FIXME: no way to detect errors until we read...
-		src = bzip2.NewReader(f)
-		checkfilename = strings.TrimSuffix(filename, ".bz2")
-	}
-	if strings.HasSuffix(filename, ".xz") {
-		zr, err := xz.NewReader(f)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "WARNING: filename looks like xz but failed to open: %s\n", err.Error())
-		} else {
-			src = zr
+		err = s.compute(ctx, in)
+	} else {
+		s.CheckFilename = checkFilename(filename)
+		s.vdata, err = readCheckFile(s.CheckFilename)
+		if err == nil {
+			err = s.verify(ctx, in)
+		} else if os.IsNotExist(err) && s.computeMissing {
+			s.vdata = nil
+			err = s.compute(ctx, in)
 		}
-		checkfilename = strings.TrimSuffix(filename, ".xz")
-	}
-	checkfilename += ".qcd"
-	var vdata map[string]string
-
-	vb, err := ioutil.ReadFile(checkfilename)
-	if err == nil {
-		err = json.Unmarshal(vb, &vdata)
 	}
 	if err != nil {
 		return nil, err
 	}
+	return s, nil
+}
 
+// verify checks the source data against its checksum information,
+// and then reads the masked records.
+func (s *Source) verify(ctx context.Context, src io.Reader) error {
 	ck := &Checksummer{}
-	s := bufio.NewScanner(src)
-	s.Buffer(make([]byte, maxLineLength), maxLineLength)
-	val, numbad, err := ck.VerifyScanner(s, vdata)
-	f.Close()
+	if err := ck.SetKey(s.key); err != nil {
+		return err
+	}
+	ck.SetMaxRecordLength(s.maxRecord)
+	val, numbad, err := ck.verifyScanner(ctx, ck.newScanner(src), s.vdata)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if !val || numbad > 0 {
-		return nil, fmt.Errorf("source failed self-verification")
+		return fmt.Errorf("source failed self-verification")
+	}
+
+	s.lineMask, s.lineRepl = ck.replacer, ck.replacement
+	if s.forceMask {
+		s.lineMask, s.lineRepl = nil, []byte(s.maskReplace)
+		if s.maskRegex != "" {
+			s.lineMask, err = regexp.Compile(s.maskRegex)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	data := make([]string, 0, ck.nrecs)
-	f, err = os.Open(filename)
+	in, err := OpenInput(s.Filename)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer in.Close()
+
+	sc := newRecordReader(ck, in)
+	done := ctx.Done()
+	for sc.Scan() {
+		if isDone(done) {
+			return ctx.Err()
+		}
+		record, err := ck.parseRecord(sc.Bytes())
+		if err != nil {
+			return &RecordError{Line: sc.cur.line, Err: err}
+		}
+		if s.lineMask != nil || ck.json != nil || ck.layout != nil {
+			s.raw = append(s.raw, string(sc.Bytes()))
+		}
+		if s.lineMask != nil {
+			record = s.lineMask.ReplaceAllLiteral(record, s.lineRepl)
+		}
+		data = append(data, string(record))
+	}
+	s.ck = ck
+	s.lines = data
+	return sc.Err()
+}
 
-	if strings.HasSuffix(filename, ".gz") {
-		zr, _ := gzip.NewReader(f)
-		src = zr
+// compute reads the masked records and computes their checksum
+// information in a single pass.
+func (s *Source) compute(ctx context.Context, src io.Reader) error {
+	ck := &Checksummer{}
+	err := ck.SetHasher(s.hasher)
+	if err == nil {
+		err = ck.SetKey(s.key)
 	}
-	if strings.HasSuffix(filename, ".bz2") {
-		// FIXME: no way to detect errors until we read...
-		src = bzip2.NewReader(f)
+	if err == nil && s.maskRegex != "" {
+		err = ck.SetRegex(s.maskRegex, s.maskReplace)
 	}
-	if strings.HasSuffix(filename, ".xz") {
-		zr, _ := xz.NewReader(f)
-		src = zr
+	if err == nil {
+		err = ck.SetLineMode(s.lineMode)
 	}
-
-	s = bufio.NewScanner(src)
-	s.Buffer(make([]byte, maxLineLength), maxLineLength)
-	for s.Scan() {
-		record := s.Bytes()
-		if ck.replacer != nil {
-			record = ck.replacer.ReplaceAllLiteral(record, ck.replacement)
+	if err == nil && s.json != nil {
+		err = ck.SetJSON(s.json)
+	}
+	if err == nil && s.layout != nil {
+		err = ck.SetLayout(s.layout)
+	}
+	if err != nil {
+		return err
+	}
+	ck.SetMaxRecordLength(s.maxRecord)
+	// records are compared directly, so skip building a records_hash
+	ck.recHashes = newQuickSum(DisableQuickSums)
+	s.lineMask, s.lineRepl = ck.replacer, ck.replacement
+
+	var data []string
+	sc := newRecordReader(ck, src)
+	done := ctx.Done()
+	for sc.Scan() {
+		if isDone(done) {
+			return ctx.Err()
 		}
-
+		record, err := ck.normalize(sc.Bytes())
+		if err != nil {
+			return &RecordError{Line: sc.cur.line, Err: err}
+		}
+		if ck.replacer != nil || ck.json != nil || ck.layout != nil {
+			s.raw = append(s.raw, string(sc.Bytes()))
+		}
+		ck.addRecord(record)
 		data = append(data, string(record))
 	}
-	f.Close()
+	s.ck = ck
+	s.lines = data
+	return sc.Err()
+}
 
-	return &Source{
-		CheckFilename: checkfilename,
-		ck:            ck,
-		Filename:      filename,
-		lines:         data,
-	}, nil
+// newRecordReader returns a lineReader which splits data into records
+// in the same way as the Checksummer, but always holds them in memory.
+func newRecordReader(ck *Checksummer, r io.Reader) *lineReader {
+	lr := newLineReader(r, 0, DefaultLines, func() hash.Hash { return nil })
+	ck.setupScanner(lr)
+	return lr
 }
 
-func (s *Source) DiffAgainst(other *Source, w io.Writer) bool {
-	outLines := make(map[string]struct{})
+// rawRecord returns the i'th record before any masking was applied.
+func (s *Source) rawRecord(i int) string {
+	if s.raw != nil {
+		return s.raw[i]
+	}
+	return s.lines[i]
+}
 
-	allmatch := true
-	i, j := 0, 0
-	for i < len(s.lines) && j < len(other.lines) {
-		var rightHash [sha256.Size]byte
-
-		if i == len(s.lines) {
-			rightHash = sha256.Sum256([]byte(other.lines[j]))
-			t := "+"
-			if s.ck.recHashes.Has(rightHash[:]) {
-				t = "*"
-				if _, ok := outLines[other.lines[j]]; ok {
-					j++
-					continue
-				}
-			}
+// HasCheckFile returns true if the source was verified against an
+// existing QCD checksum file, or false if its checksum was computed.
+func (s *Source) HasCheckFile() bool {
+	return s.vdata != nil
+}
 
-			fmt.Fprintln(w, t+other.lines[j])
-			j++
-			allmatch = false
-			continue
-		}
+// Mask returns the regex and replacement used to mask the source's
+// records for comparison, or empty strings if none was used.
+func (s *Source) Mask() (regex, replacement string) {
+	if s.lineMask == nil {
+		return "", ""
+	}
+	return s.lineMask.String(), string(s.lineRepl)
+}
 
-		leftHash := sha256.Sum256([]byte(s.lines[i]))
-		rightHasLeft := other.ck.recHashes.Has(leftHash[:])
-		if j == len(other.lines) {
-			t := "-"
-			if rightHasLeft {
-				t = "*"
-				if _, ok := outLines[s.lines[i]]; ok {
-					i++
-					continue
-				}
-			}
+// MaskMismatchError is returned when comparing two sources whose records
+// were masked differently, which would produce a meaningless result.
+type MaskMismatchError struct {
+	Left, Right string
+}
 
-			fmt.Fprintln(w, t+s.lines[i])
-			i++
-			allmatch = false
-			continue
-		}
-		rightHash = sha256.Sum256([]byte(other.lines[j]))
-		leftHasRight := s.ck.recHashes.Has(rightHash[:])
+func (e *MaskMismatchError) Error() string {
+	return fmt.Sprintf("sources were masked differently (%s vs %s), use a common mask to compare them",
+		e.Left, e.Right)
+}
 
-		// easy match
-		if s.lines[i] == other.lines[j] {
-			outLines[s.lines[i]] = struct{}{}
-			fmt.Fprintln(w, " "+s.lines[i])
-			i++
-			j++
-			continue
+func describeMask(regex, replacement string) string {
+	if regex == "" {
+		return "no mask"
+	}
+	return fmt.Sprintf("'%s' => '%s'", regex, replacement)
+}
+
+// checkMasks returns a MaskMismatchError if the sources were masked
+// differently, or an error if their records were parsed differently.
+func (s *Source) checkMasks(other *Source) error {
+	if err := checkRecordFormats(s.formatInfo(), other.formatInfo()); err != nil {
+		return err
+	}
+	rx, repl := s.Mask()
+	orx, orepl := other.Mask()
+	if rx != orx || repl != orepl {
+		return &MaskMismatchError{
+			Left:  describeMask(rx, repl),
+			Right: describeMask(orx, orepl),
 		}
+	}
+	return nil
+}
 
-		/////
-		// ok the standard diff would simply try to figure out
-		// if something was added or removed from the left/right
-		// ... but first we need to check if either was found
-		//     somewhere on the opposite side out of order.
+// formatInfo returns the keys of the source's Info() which describe how
+// its data is split into records.
+func (s *Source) formatInfo() map[string]string {
+	r := make(map[string]string)
+	if s.ck.lineMode != DefaultLines {
+		r["line_mode"] = string(s.ck.lineMode)
+	}
+	if s.ck.json != nil {
+		s.ck.json.info(r)
+	}
+	if s.ck.layout != nil {
+		s.ck.layout.info(r)
+	}
+	return r
+}
 
-		if rightHasLeft && leftHasRight {
-			// lines are out of order, keep the left-side ordering
-			// and make sure that we output the right side at some point
+// jsonOptions returns the source's JSON record format options, or nil.
+func (s *Source) jsonOptions() *JSONOptions {
+	if s.ck.json == nil {
+		return nil
+	}
+	return &s.ck.json.opts
+}
 
-			if _, ok := outLines[other.lines[j]]; ok {
-				// right side was already output
-				j++
+// recordLayout returns the source's fixed-width record layout, or nil.
+func (s *Source) recordLayout() *Layout {
+	if s.ck.layout == nil {
+		return nil
+	}
+	return &s.ck.layout.layout
+}
 
-				// by continuing, we have a chance for the left side
-				// to exact-match the next line of the right side
-				continue
-			}
+// framed returns true if the source's records are framed by length
+// rather than lines.
+func (s *Source) framed() bool {
+	return s.ck.layout != nil && s.ck.layout.layout.RecordLength > 0
+}
 
-			if _, ok := outLines[s.lines[i]]; ok {
-				// right side has never been output, but
-				// left side was already output (maybe by the right side?)
-				i++
+// Info returns the checksum information for the source.
+func (s *Source) Info() map[string]string {
+	if s.vdata != nil {
+		return s.vdata
+	}
+	return s.ck.Info()
+}
 
-				// by continuing, we have a chance for the right side
-				// to exact-match the next line of the left side
-				continue
-			}
+// NewSourcePair creates two data sources to be compared. If only one of
+// them has a QCD checksum file (see WithoutCheckFile), its mask and
+// record format are also applied to the other so that the comparison is
+// consistent.
+func NewSourcePair(leftFilename, rightFilename string, opts ...SourceOption) (*Source, *Source, error) {
+	left, err := NewSource(leftFilename, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	right, err := NewSource(rightFilename, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if left.HasCheckFile() == right.HasCheckFile() {
+		return left, right, nil
+	}
 
-			// neither left or right has been output
-			// we try to maintain left-ordering, so output that line now
-			outLines[s.lines[i]] = struct{}{}
-			fmt.Fprintln(w, "*"+s.lines[i])
+	rx, repl := left.Mask()
+	orx, orepl := right.Mask()
+	if rx == orx && repl == orepl && checkRecordFormats(left.formatInfo(), right.formatInfo()) == nil {
+		return left, right, nil
+	}
+	if left.HasCheckFile() {
+		right, err = NewSource(rightFilename, append(opts, WithMask(rx, repl), WithLineMode(left.ck.lineMode),
+			WithMaxRecordLength(widerRecordLimit(left.ck.maxRecord, right.maxRecord)),
+			WithJSON(left.jsonOptions()), WithLayout(left.recordLayout()))...)
+	} else {
+		left, err = NewSource(leftFilename, append(opts, WithMask(orx, orepl), WithLineMode(right.ck.lineMode),
+			WithMaxRecordLength(widerRecordLimit(right.ck.maxRecord, left.maxRecord)),
+			WithJSON(right.jsonOptions()), WithLayout(right.recordLayout()))...)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return left, right, nil
+}
+
+// checkFilename returns the name of the QCD checksum file for a data file.
+func checkFilename(filename string) string {
+	return TrimCompressionExt(filename) + ".qcd"
+}
+
+// readCheckFile loads QCD checksum information previously written
+// from a Checksummer's Info(), or the dataset information of a Manifest.
+func readCheckFile(checkfilename string) (map[string]string, error) {
+	m, err := ReadManifest(checkfilename)
+	if err != nil {
+		return nil, err
+	}
+	return m.Dataset, nil
+}
+
+// DiffAgainst writes a line-oriented diff of the other source relative to
+// this one to w. Each record is written once, prefixed with:
+//
+//	" " if it is in the same position in both sources
+//	"*" if it is in both sources but out of order
+//	"-" if it is only in this source
+//	"+" if it is only in the other source
+//
+// See Diff for details. Returns a summary of the differences, use its
+// Same method to check if both sources contain the same records.
+func (s *Source) DiffAgainst(other *Source, w io.Writer) (DiffSummary, error) {
+	return s.Diff(other, NewTextDiffSink(w))
+}
+
+// Diff compares the other source relative to this one, reporting every
+// record once to the sink. Records are compared as a multiset, so a
+// record duplicated on only one side is reported as added or removed.
+// Output follows the ordering of this source where possible. Returns a
+// count of each type of change, or a MaskMismatchError if the sources
+// were masked differently.
+func (s *Source) Diff(other *Source, sink DiffSink) (DiffSummary, error) {
+	if err := s.checkMasks(other); err != nil {
+		return DiffSummary{}, err
+	}
+	left, right := s.lines, other.lines
+
+	// number of not-yet-output occurrences of each record at or after
+	// the current position, and the number of occurrences further ahead
+	// that have already been output out of order.
+	leftRemain := make(map[string]int)
+	rightRemain := make(map[string]int)
+	leftSkip := make(map[string]int)
+	rightSkip := make(map[string]int)
+	for _, line := range left {
+		leftRemain[line]++
+	}
+	for _, line := range right {
+		rightRemain[line]++
+	}
+
+	var sum DiffSummary
+	for line, n := range leftRemain {
+		if m := rightRemain[line]; m > 0 && m != n {
+			sum.DuplicatesChanged++
+		}
+	}
+
+	var err error
+	emit := func(c DiffChange, record string, leftLine, rightLine int) {
+		sum.add(c)
+		if err == nil {
+			err = sink.Event(DiffEvent{Change: c, Record: trimTerminator([]byte(record)),
+				LeftLine: leftLine, RightLine: rightLine})
+		}
+	}
+
+	i, j := 0, 0
+	for (i < len(left) || j < len(right)) && err == nil {
+		// skip over records that were already output out of order
+		if i < len(left) && leftSkip[left[i]] > 0 {
+			leftSkip[left[i]]--
 			i++
-			// since we know that the left has the right somewhere, it's safe to skip now
+			continue
+		}
+		if j < len(right) && rightSkip[right[j]] > 0 {
+			rightSkip[right[j]]--
 			j++
 			continue
 		}
 
-		if rightHasLeft {
-			// left side has no knowledge of the right, call it new
-			outLines[other.lines[j]] = struct{}{}
-			fmt.Fprintln(w, "+"+other.lines[j])
+		// easy match
+		if i < len(left) && j < len(right) && left[i] == right[j] {
+			emit(Matched, left[i], i+1, j+1)
+			leftRemain[left[i]]--
+			rightRemain[right[j]]--
+			i++
 			j++
-			allmatch = false
 			continue
 		}
 
-		if leftHasRight {
-			// right side has no knowledge of the left, call it removed
-			outLines[s.lines[i]] = struct{}{}
-			fmt.Fprintln(w, "-"+s.lines[i])
+		// the right side has no (more) copies of the left, call it removed
+		if i < len(left) && rightRemain[left[i]] == 0 {
+			emit(Removed, left[i], i+1, 0)
+			leftRemain[left[i]]--
 			i++
-			allmatch = false
 			continue
 		}
 
-		// if we made it here both sides are unknown to the other
-		outLines[other.lines[j]] = struct{}{}
-		outLines[s.lines[i]] = struct{}{}
+		// the left side has no (more) copies of the right, call it new
+		if j < len(right) && leftRemain[right[j]] == 0 {
+			emit(Added, right[j], 0, j+1)
+			rightRemain[right[j]]--
+			j++
+			continue
+		}
 
-		fmt.Fprintln(w, "-"+s.lines[i])
-		fmt.Fprintln(w, "+"+other.lines[j])
-		i++
+		// the record is on both sides but out of order. keep the left-side
+		// ordering and skip the matching right side record when we get to it.
+		if i < len(left) {
+			emit(Moved, left[i], i+1, 0)
+			leftRemain[left[i]]--
+			rightRemain[left[i]]--
+			rightSkip[left[i]]++
+			i++
+			continue
+		}
+		emit(Moved, right[j], 0, j+1)
+		rightRemain[right[j]]--
+		leftRemain[right[j]]--
+		leftSkip[right[j]]++
 		j++
-		allmatch = false
 	}
-	return allmatch
+	if err != nil {
+		return sum, err
+	}
+	return sum, sink.Close()
 }
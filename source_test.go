@@ -0,0 +1,118 @@
+package qcd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSource writes data and its QCD checksum file, checksummed by ck.
+func writeSource(t *testing.T, dir, name, data string, ck *Checksummer) string {
+	t.Helper()
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ck.Sum(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Dataset: ck.Info()}
+	if err := m.WriteFile(checkFilename(filename)); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestDiffCanonicalLines(t *testing.T) {
+	dir := t.TempDir()
+	newCk := func() *Checksummer {
+		ck := &Checksummer{}
+		ck.SetLineMode(CanonicalLines)
+		return ck
+	}
+	left := writeSource(t, dir, "left.txt", "\xef\xbb\xbfx\r\n\r\ny\r\n\r\n\r\n", newCk())
+	right := writeSource(t, dir, "right.txt", "x\n\ny", newCk())
+
+	l, r, err := NewSourcePair(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Info()["content_hash"] != r.Info()["content_hash"] {
+		t.Fatal("content hashes differ")
+	}
+	sum, err := l.Diff(r, DiscardDiffSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sum.Same() || sum.Identical != 3 {
+		t.Errorf("Source.Diff: %s, want 3 identical", sum)
+	}
+
+	sd := &StreamDiff{TempDir: dir, Partitions: 4}
+	ssum, err := sd.DiffTo(left, right, DiscardDiffSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ssum.Same() {
+		t.Errorf("StreamDiff: %s, want the same records", ssum)
+	}
+}
+
+// eventSink records the events of a diff in the text diff format.
+type eventSink struct {
+	events []string
+	closed bool
+}
+
+func (s *eventSink) Event(e DiffEvent) error {
+	s.events = append(s.events, e.Change.prefix()+e.Record)
+	return nil
+}
+
+func (s *eventSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSourceDiff(t *testing.T) {
+	cases := []struct {
+		name        string
+		left, right string
+		want        DiffSummary
+		events      string
+	}{
+		{"identical", "a\nb\n", "a\nb\n", DiffSummary{Identical: 2}, " a  b"},
+		{"reordered", "a\nb\nc\n", "c\na\nb\n", DiffSummary{Identical: 1, Moved: 2}, "*a *b  c"},
+		{"duplicated", "a\nb\n", "a\nb\nb\n", DiffSummary{Identical: 2, Added: 1, DuplicatesChanged: 1}, " a  b +b"},
+		{"deduped", "a\na\nb\n", "a\nb\n", DiffSummary{Identical: 2, Removed: 1, DuplicatesChanged: 1}, " a -a  b"},
+		{"moved", "a\nb\nc\n", "b\nc\nx\na\n", DiffSummary{Identical: 2, Moved: 1, Added: 1}, "*a  b  c +x"},
+		{"replaced", "a\nb\n", "a\nc\n", DiffSummary{Identical: 1, Added: 1, Removed: 1}, " a -b +c"},
+	}
+	for _, tc := range cases {
+		dir := t.TempDir()
+		left := writeSource(t, dir, "left.txt", tc.left, &Checksummer{})
+		right := writeSource(t, dir, "right.txt", tc.right, &Checksummer{})
+		l, r, err := NewSourcePair(left, right)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink := &eventSink{}
+		sum, err := l.Diff(r, sink)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if sum != tc.want {
+			t.Errorf("%s: summary %+v, want %+v", tc.name, sum, tc.want)
+		}
+		if got := strings.Join(sink.events, " "); got != tc.events {
+			t.Errorf("%s: events %q, want %q", tc.name, got, tc.events)
+		}
+		if !sink.closed {
+			t.Errorf("%s: sink was not closed", tc.name)
+		}
+		if same := tc.want.Added == 0 && tc.want.Removed == 0; sum.Same() != same {
+			t.Errorf("%s: Same() = %v, want %v", tc.name, sum.Same(), same)
+		}
+	}
+}
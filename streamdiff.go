@@ -0,0 +1,391 @@
+package qcd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// DefaultPartitions is the number of temporary partitions each input is
+// split into by a StreamDiff. Memory use is bounded by the size of the
+// largest partition of the left-hand input.
+const DefaultPartitions = 256
+
+// StreamDiff compares two data files without loading either into memory.
+// The zero-value is ready to use with files which have QCD checksum
+// files, set NewChecksummer to also compare files without them.
+//
+// Records that the other side's records_hash proves are missing are
+// reported as soon as they are read. All remaining records are
+// hash-partitioned into temporary files on local disk, and the matching
+// partitions of each side are then compared one at a time.
+type StreamDiff struct {
+	// TempDir is where partition files are created, os.TempDir() if empty.
+	TempDir string
+
+	// Partitions is the number of partitions per input, DefaultPartitions if 0.
+	Partitions int
+
+	// Key is the secret used for keyed record hashing, if the inputs used one.
+	Key []byte
+
+	// CommonMask, if set, is a regex used to mask the records of both
+	// inputs for comparison, replacing matches with CommonReplacement.
+	// Because the records_hash of each input was built using its own mask,
+	// every record must then be partitioned, which uses more disk space.
+	CommonMask        string
+	CommonReplacement string
+
+	// NewChecksummer, if set, creates the Checksummer used to compute the
+	// checksum information of an input without a QCD checksum file, at
+	// the cost of an extra pass over it. It must use Key. If the other
+	// input has a QCD checksum file, its mask and record format are used
+	// instead, as in NewSourcePair.
+	NewChecksummer func() *Checksummer
+
+	common *regexp.Regexp
+}
+
+type streamSide struct {
+	filename string
+	vdata    map[string]string
+	ck       *Checksummer
+	parts    []string
+}
+
+// Diff writes the records added ("+") to and removed ("-") from the right
+// file relative to the left file to w. Unlike Source.DiffAgainst, records
+// are compared as a multiset, so output is in no particular order and
+// matching or reordered records are not written. Returns a summary of the
+// differences, in which all matching records are counted as identical.
+func (d *StreamDiff) Diff(leftFilename, rightFilename string, w io.Writer) (DiffSummary, error) {
+	return d.DiffTo(leftFilename, rightFilename, NewTextDiffSink(w))
+}
+
+// DiffTo reports the records added to and removed from the right file
+// relative to the left file to the sink, see Diff for details.
+func (d *StreamDiff) DiffTo(leftFilename, rightFilename string, sink DiffSink) (DiffSummary, error) {
+	var sum DiffSummary
+	left, err := d.open(leftFilename)
+	if err != nil {
+		return sum, err
+	}
+	right, err := d.open(rightFilename)
+	if err != nil {
+		return sum, err
+	}
+	if err = d.compute(left, right.vdata); err != nil {
+		return sum, err
+	}
+	if err = d.compute(right, left.vdata); err != nil {
+		return sum, err
+	}
+
+	if left.ck.lineMode != right.ck.lineMode {
+		return sum, fmt.Errorf("sources were split into records differently (line_mode '%s' vs '%s')",
+			left.ck.lineMode, right.ck.lineMode)
+	}
+
+	if err = checkRecordFormats(left.vdata, right.vdata); err != nil {
+		return sum, err
+	}
+
+	d.common = nil
+	if d.CommonMask != "" {
+		d.common, err = regexp.Compile(d.CommonMask)
+		if err != nil {
+			return sum, err
+		}
+	} else {
+		lm := describeMask(left.vdata["mask_regex"], left.vdata["mask_replacement"])
+		rm := describeMask(right.vdata["mask_regex"], right.vdata["mask_replacement"])
+		if lm != rm {
+			return sum, &MaskMismatchError{Left: lm, Right: rm}
+		}
+	}
+
+	dir, err := ioutil.TempDir(d.TempDir, "qcdiff")
+	if err != nil {
+		return sum, err
+	}
+	defer os.RemoveAll(dir)
+
+	err = d.partition(left, right, filepath.Join(dir, "left"), Removed, sink, &sum)
+	if err != nil {
+		return sum, err
+	}
+	err = d.partition(right, left, filepath.Join(dir, "right"), Added, sink, &sum)
+	if err != nil {
+		return sum, err
+	}
+
+	for p := range left.parts {
+		err = diffPartition(left.parts[p], right.parts[p], sink, &sum)
+		if err != nil {
+			return sum, err
+		}
+		os.Remove(left.parts[p])
+		os.Remove(right.parts[p])
+	}
+	return sum, sink.Close()
+}
+
+// open loads the QCD checksum information for a data file. If it has
+// none and NewChecksummer is set, it is left to compute.
+func (d *StreamDiff) open(filename string) (*streamSide, error) {
+	in, err := OpenInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	in.Close()
+
+	side := &streamSide{filename: filename}
+	side.vdata, err = readCheckFile(checkFilename(filename))
+	if os.IsNotExist(err) && d.NewChecksummer != nil {
+		return side, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return side, d.setup(side)
+}
+
+// setup creates the Checksummer used to verify and hash the records of
+// a side from its checksum information.
+func (d *StreamDiff) setup(side *streamSide) error {
+	ck := &Checksummer{}
+	if err := ck.SetKey(d.Key); err != nil {
+		return err
+	}
+	if err := ck.setupVerify(side.vdata); err != nil {
+		return err
+	}
+	side.ck = ck
+	return nil
+}
+
+// compute reads a side without a QCD checksum file to compute its
+// checksum information, splitting and masking records like the other
+// side's checksum information if it has one.
+func (d *StreamDiff) compute(side *streamSide, other map[string]string) error {
+	if side.vdata != nil {
+		return nil
+	}
+	if side.filename == Stdin {
+		// the data must be read twice
+		return fmt.Errorf("no QCD checksum file for standard input")
+	}
+	ck := d.NewChecksummer()
+	if other != nil {
+		if err := ck.setupFormat(other); err != nil {
+			return err
+		}
+	}
+	in, err := OpenInput(side.filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = ck.Sum(in); err != nil {
+		return err
+	}
+	side.vdata = ck.Info()
+	return d.setup(side)
+}
+
+// partition reads every record of side, verifying its content hash as it
+// goes. Records which are not in the other side's records_hash are sent
+// immediately to the sink as the given change, the remainder are written
+// to partition files named with the given base.
+func (d *StreamDiff) partition(side, other *streamSide, base string, change DiffChange, sink DiffSink, sum *DiffSummary) error {
+	n := d.Partitions
+	if n <= 0 {
+		n = DefaultPartitions
+	}
+
+	in, err := OpenInput(side.filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	files := make([]*os.File, n)
+	bufs := make([]*bufio.Writer, n)
+	side.parts = make([]string, n)
+	defer func() {
+		for _, pf := range files {
+			if pf != nil {
+				pf.Close()
+			}
+		}
+	}()
+	for p := range files {
+		side.parts[p] = fmt.Sprintf("%s.%04d", base, p)
+		files[p], err = os.Create(side.parts[p])
+		if err != nil {
+			return err
+		}
+		bufs[p] = bufio.NewWriterSize(files[p], 32*1024)
+	}
+
+	// if both sides hash records the same way, there's no need to
+	// hash each record twice
+	sameHashing := side.ck.hasher.Name() == other.ck.hasher.Name() &&
+		side.ck.keyID == other.ck.keyID
+
+	var lenbuf [binary.MaxVarintLen64]byte
+	// records are partitioned, so they can't be streamed through a hash
+	s := newRecordReader(side.ck, in)
+	for s.Scan() {
+		record, err := side.ck.normalize(s.Bytes())
+		if err != nil {
+			return &RecordError{Line: s.cur.line, Err: err}
+		}
+		h := side.ck.hashRecord(record)
+		side.ck.nrecs++
+		xorBytes(side.ck.sum[:], side.ck.sum[:], h[:])
+
+		if d.common != nil {
+			// the records_hash can't be used with a different mask. The
+			// record was already parsed by normalize, so it is valid.
+			record, _ = side.ck.parseRecord(s.Bytes())
+			record = d.common.ReplaceAllLiteral(record, []byte(d.CommonReplacement))
+		} else if !sameHashing {
+			h = other.ck.hashRecord(record)
+		}
+		if d.common == nil && !other.ck.recHashes.Has(h[:]) {
+			sum.add(change)
+			err = sink.Event(DiffEvent{Change: change, Record: trimTerminator(record)})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// records are length-prefixed in case a mask introduced a newline
+		p := partitionOf(record, n)
+		ln := binary.PutUvarint(lenbuf[:], uint64(len(record)))
+		bufs[p].Write(lenbuf[:ln])
+		bufs[p].Write(record)
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+	if side.vdata["content_hash"] != fmt.Sprintf("%064x", side.ck.sum) {
+		return fmt.Errorf("%s failed self-verification", side.filename)
+	}
+
+	for _, b := range bufs {
+		if err = b.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimTerminator returns a record without the line terminator which is
+// part of it in ExactLines mode.
+func trimTerminator(record []byte) string {
+	if bytes.HasSuffix(record, []byte{'\n'}) {
+		record = bytes.TrimSuffix(record[:len(record)-1], []byte{'\r'})
+	}
+	return string(record)
+}
+
+// partitionOf returns the partition number for a record.
+func partitionOf(record []byte, n int) int {
+	h := fnv.New64a()
+	h.Write(record)
+	return int(h.Sum64() % uint64(n))
+}
+
+// readPartition calls fn for every record in a partition file.
+func readPartition(filename string, fn func(record []byte) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var record []byte
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if uint64(cap(record)) < n {
+			record = make([]byte, n)
+		}
+		record = record[:n]
+		if _, err = io.ReadFull(r, record); err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// diffPartition compares the multiset of records in the left and right
+// partition files, sending the differences to the sink.
+func diffPartition(leftPart, rightPart string, sink DiffSink, sum *DiffSummary) error {
+	counts := make(map[string]int)
+	var order []string
+	err := readPartition(leftPart, func(record []byte) error {
+		k := string(record)
+		if _, ok := counts[k]; !ok {
+			order = append(order, k)
+		}
+		counts[k]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// number of times each left-side record was matched on the right
+	matched := make(map[string]int)
+	err = readPartition(rightPart, func(record []byte) error {
+		k := string(record)
+		if counts[k] > 0 {
+			counts[k]--
+			matched[k]++
+			sum.add(Matched)
+			return nil
+		}
+		if matched[k] > 0 {
+			// record is on both sides, but more times on the right
+			matched[k] = -1
+			sum.DuplicatesChanged++
+		}
+		sum.add(Added)
+		return sink.Event(DiffEvent{Change: Added, Record: trimTerminator([]byte(k))})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range order {
+		if counts[k] > 0 && matched[k] > 0 {
+			sum.DuplicatesChanged++
+		}
+		for i := 0; i < counts[k]; i++ {
+			sum.add(Removed)
+			if err = sink.Event(DiffEvent{Change: Removed, Record: trimTerminator([]byte(k))}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package qcd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamDiffWithoutCheckFile(t *testing.T) {
+	dir := t.TempDir()
+	newCk := func() *Checksummer {
+		ck := &Checksummer{}
+		ck.SetRegex("[0-9]+", "#")
+		return ck
+	}
+	left := writeSource(t, dir, "left.txt", "a 1\nb 2\nc 3\n", newCk())
+	right := filepath.Join(dir, "right.txt")
+	if err := ioutil.WriteFile(right, []byte("b 5\na 4\nd 6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sd := &StreamDiff{TempDir: dir, Partitions: 4}
+	if _, err := sd.DiffTo(left, right, DiscardDiffSink); err == nil {
+		t.Error("StreamDiff without NewChecksummer: want an error for a missing checksum file")
+	}
+
+	// the right side is masked like the left
+	sd.NewChecksummer = func() *Checksummer { return &Checksummer{} }
+	sum, err := sd.DiffTo(left, right, DiscardDiffSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Identical != 2 || sum.Added != 1 || sum.Removed != 1 {
+		t.Errorf("StreamDiff: %s, want 2 identical, 1 added, 1 removed", sum)
+	}
+
+	// neither side has a checksum file
+	sum, err = sd.DiffTo(right, right, DiscardDiffSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sum.Same() || sum.Identical != 3 {
+		t.Errorf("StreamDiff: %s, want 3 identical", sum)
+	}
+}
+
+func TestStreamDiffWithoutCheckFileMask(t *testing.T) {
+	dir := t.TempDir()
+	left := writeSource(t, dir, "left.txt", "a 1\nb 2\n", &Checksummer{})
+	right := filepath.Join(dir, "right.txt")
+	if err := ioutil.WriteFile(right, []byte("b 2\na 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the right side is not masked, like the left
+	sd := &StreamDiff{TempDir: dir, Partitions: 4}
+	sd.NewChecksummer = func() *Checksummer {
+		ck := &Checksummer{}
+		ck.SetRegex("[0-9]+", "#")
+		return ck
+	}
+	sum, err := sd.DiffTo(left, right, DiscardDiffSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Identical != 1 || sum.Added != 1 || sum.Removed != 1 {
+		t.Errorf("StreamDiff: %s, want 1 identical, 1 added, 1 removed", sum)
+	}
+}
@@ -0,0 +1,34 @@
+#!/bin/bash
+# compares the record hash algorithms available to qcd against
+# whole-file md5 and sha256 checksums.
+#
+# usage: ./hashBench.sh data.csv
+original=$1
+algorithms="sha256 sha512_256 blake2b blake3 xxh3"
+
+echo -e "Method\treal\tuser\tsys" > hashlog.txt
+
+for alg in $algorithms
+do
+  # -v "" disables both verification and writing of the manifest
+  (time ./qcd -a $alg -v "" < $original) 2> timeqcd.txt
+  qcdreal=$(grep real timeqcd.txt | awk '{print $2}')
+  qcduser=$(grep user timeqcd.txt | awk '{print $2}')
+  qcdsys=$(grep sys timeqcd.txt | awk '{print $2}')
+  echo -e "qcd-$alg\t$qcdreal\t$qcduser\t$qcdsys" >> hashlog.txt
+done
+
+(time md5sum $original) 2> timemd5.txt 1>/dev/null
+md5real=$(grep real timemd5.txt | awk '{print $2}')
+md5user=$(grep user timemd5.txt | awk '{print $2}')
+md5sys=$(grep sys timemd5.txt | awk '{print $2}')
+echo -e "md5\t$md5real\t$md5user\t$md5sys" >> hashlog.txt
+
+(time sha256sum $original) 2> timesha256.txt 1>/dev/null
+sha256real=$(grep real timesha256.txt | awk '{print $2}')
+sha256user=$(grep user timesha256.txt | awk '{print $2}')
+sha256sys=$(grep sys timesha256.txt | awk '{print $2}')
+echo -e "sha256\t$sha256real\t$sha256user\t$sha256sys" >> hashlog.txt
+
+rm timeqcd.txt timemd5.txt timesha256.txt
+cat hashlog.txt
@@ -0,0 +1,84 @@
+#!/bin/bash
+# regression tests for qcdiff, expects ./qcd and ./qcdiff binaries
+#
+# each case is: name, left file contents, right file contents,
+# qcd mask regex (or empty), expected qcdiff output, expected exit status
+cases=(
+  "identical"   "a\nb\nc\n"    "a\nb\nc\n"      ""  " a\n b\n c"      0
+  "appended"    "a\nb\n"       "a\nb\nc\nd\n"   ""  " a\n b\n+c\n+d"  1
+  "prepended"   "b\nc\n"       "a\nb\nc\n"      ""  "+a\n b\n c"      1
+  "truncated"   "a\nb\nc\n"    "a\n"            ""  " a\n-b\n-c"      1
+  "reordered"   "a\nb\nc\n"    "c\na\nb\n"      ""  "*a\n*b\n c"      0
+  "swapped"     "a\nb\n"       "b\na\n"         ""  "*a\n b"          0
+  "duplicated"  "a\nb\n"       "a\nb\nb\n"      ""  " a\n b\n+b"      1
+  "deduped"     "a\na\nb\n"    "a\nb\n"         ""  " a\n-a\n b"      1
+  "replaced"    "a\nb\nc\n"    "a\nx\nc\n"      ""  " a\n-b\n+x\n c"  1
+  "masked"      "a,2019-01-01\nb,2019-01-02\n" "a,2020-03-04\nb,2020-03-05\n" \
+    "[0-9]{4}-[0-9]{2}-[0-9]{2}" " a,DATE\n b,DATE" 0
+)
+
+failed=0
+i=0
+while [ $i -lt ${#cases[@]} ]
+do
+  name=${cases[$i]}
+  printf "${cases[$i+1]}" > left.txt
+  printf "${cases[$i+2]}" > right.txt
+  rx=${cases[$i+3]}
+  expected=$(printf "${cases[$i+4]}")
+  expectedStatus=${cases[$i+5]}
+  i=$((i+6))
+
+  rm -f left.txt.qcd right.txt.qcd
+  if [[ -n $rx ]]
+  then
+    ./qcd -r "$rx" -x DATE left.txt 2>/dev/null
+    ./qcd -r "$rx" -x DATE right.txt 2>/dev/null
+  else
+    ./qcd left.txt 2>/dev/null
+    ./qcd right.txt 2>/dev/null
+  fi
+
+  output=$(./qcdiff left.txt right.txt 2>/dev/null)
+  status=$?
+  if [[ "$output" == "$expected" && $status == $expectedStatus ]]
+  then
+    echo "ok      $name"
+  else
+    echo "FAILED  $name (exit status $status, expected $expectedStatus)"
+    echo "$output" | sed 's/^/    got: /'
+    echo "$expected" | sed 's/^/    expected: /'
+    failed=1
+  fi
+done
+
+# -format selects the output format, -record-format how records are read
+rm -f left.txt.qcd right.txt.qcd
+printf 'a\nb\n' > left.txt
+printf 'a\nc\n' > right.txt
+output=$(./qcdiff -format csv left.txt right.txt 2>/dev/null)
+expected=$(printf 'change,left_line,right_line,record\nmatched,1,1,a\nremoved,2,,b\nadded,,2,c')
+if [[ "$output" == "$expected" ]]
+then
+  echo "ok      format csv"
+else
+  echo "FAILED  format csv"
+  echo "$output" | sed 's/^/    got: /'
+  failed=1
+fi
+
+printf '{"a":1,"b":2}\n' > left.txt
+printf '{"b":2, "a":1}\n' > right.txt
+output=$(./qcdiff -record-format json -summary-only left.txt right.txt 2>/dev/null)
+status=$?
+if [[ $status == 0 ]]
+then
+  echo "ok      record-format json"
+else
+  echo "FAILED  record-format json (exit status $status, expected 0)"
+  echo "$output" | sed 's/^/    got: /'
+  failed=1
+fi
+
+rm -f left.txt right.txt left.txt.qcd right.txt.qcd
+exit $failed
@@ -0,0 +1,45 @@
+#!/bin/bash
+# regression tests for qcd merge3, expects a ./qcd binary
+#
+# each case is: name, base, theirs and ours file contents, extra
+# merge3 options, expected merged output, expected exit status
+cases=(
+  "unchanged"     "a\nb\n"       "a\nb\n"       "a\nb\n"       ""  "a\nb"        0
+  "theirs-added"  "a\nb\n"       "a\nb\nc\n"    "a\nb\n"       ""  "a\nb\nc"     0
+  "both-added"    "a\n"          "a\nb\n"       "b\na\n"       ""  "a\nb"        0
+  "both-removed"  "a\nb\nc\n"    "a\nc\n"       "a\nc\n"       ""  "a\nc"        0
+  "each-changed"  "a\nb\nc\n"    "a\nB\nc\n"    "a\nb\nC\n"    ""  "a\nC\nB"     0
+  "dup-added"     "a\n"          "a\na\n"       "a\na\na\n"    ""  "a\na\na"     0
+  "key-changed"   "1,a\n2,b\n"   "1,A\n2,b\n"   "1,a\n2,B\n"   "-key 1"  "1,A\n2,B"  0
+  "key-deleted"   "1,a\n2,b\n"   "1,a\n"        "1,A\n2,b\n"   "-key 1"  "1,A"       0
+  "key-conflict"  "1,a\n2,b\n"   "1,X\n2,b\n"   "1,Y\n2,b\n"   "-key 1"  "1,Y\n2,b"  1
+)
+
+failed=0
+i=0
+while [ $i -lt ${#cases[@]} ]
+do
+  name=${cases[$i]}
+  printf "${cases[$i+1]}" > base.txt
+  printf "${cases[$i+2]}" > theirs.txt
+  printf "${cases[$i+3]}" > ours.txt
+  opts=${cases[$i+4]}
+  expected=$(printf "${cases[$i+5]}")
+  expectedStatus=${cases[$i+6]}
+  i=$((i+7))
+
+  output=$(./qcd merge3 $opts base.txt theirs.txt ours.txt 2>/dev/null)
+  status=$?
+  if [[ "$output" == "$expected" && $status == $expectedStatus ]]
+  then
+    echo "ok      $name"
+  else
+    echo "FAILED  $name (exit status $status, expected $expectedStatus)"
+    echo "$output" | sed 's/^/    got: /'
+    echo "$expected" | sed 's/^/    expected: /'
+    failed=1
+  fi
+done
+
+rm -f base.txt theirs.txt ours.txt
+exit $failed